@@ -6,37 +6,137 @@
 package main
 
 import (
+	"encoding/json"
 	"flag"
+	"fmt"
 	"io/ioutil"
 	"log"
 	"os"
 	"path/filepath"
+	"strings"
 
 	"github.com/dustin/go-humanize"
 	"github.com/u-root/gobusybox/src/pkg/bb"
 	"github.com/u-root/gobusybox/src/pkg/golang"
+	"github.com/u-root/gobusybox/src/pkg/uflag"
 )
 
 var (
-	outputPath = flag.String("o", "bb", "Path to compiled busybox binary")
-	genDir     = flag.String("gen-dir", "", "Directory to generate source in")
-	genOnly    = flag.Bool("g", false, "Generate but do not build binaries")
-	keep       = flag.Bool("k", false, "Keep generated source temporary directory")
+	outputPath    = flag.String("o", "bb", "Path to compiled busybox binary")
+	genDir        = flag.String("gen-dir", "", "Directory to generate source in")
+	genOnly       = flag.Bool("g", false, "Generate but do not build binaries")
+	keep          = flag.Bool("k", false, "Keep generated source temporary directory")
+	reuseGenDir   = flag.Bool("reuse-gen-dir", false, "Allow -gen-dir to contain source generated by a previous build, which is replaced")
+	cacheDir      = flag.String("cache-dir", "", "Directory to cache rewritten packages in across builds")
+	jobs          = flag.Int("j", 0, "Number of packages to rewrite in parallel (default GOMAXPROCS)")
+	rewriteDep    = flag.Bool("rewrite-deps", false, "Defer dependency packages' init functions and global initializers until a command using them is invoked")
+	interceptExit = flag.Bool("intercept-exits", false, "Rewrite os.Exit, log.Fatal and flag.ExitOnError in commands so that bbmain.RunInProcess can return their exit code")
+	interceptIO   = flag.Bool("intercept-stdio", false, "Rewrite os.Stdin, os.Stdout, os.Stderr and fmt.Print in commands so that bbmain.Exec can give them their own standard I/O")
+	buildInfo     = flag.Bool("build-info", false, "Record each command's build info, including its Git settings, and rewrite debug.ReadBuildInfo in commands to return it")
+	moduleMode    = flag.Bool("module-mode", false, "Generate the busybox as a Go module and build it with modules enabled, verifying dependencies against go.sum")
+	manifest      = flag.String("manifest", "", "Path to write a JSON manifest of the busybox's commands, packages and modules to")
+	spdx          = flag.String("spdx", "", "Path to write an SPDX JSON SBOM of the busybox to")
+	cyclonedx     = flag.String("cyclonedx", "", "Path to write a CycloneDX JSON SBOM of the busybox to")
+	notice        = flag.String("notice", "", "Path to write the license and notice files of all modules in the busybox to")
+	embedLicenses = flag.Bool("embed-licenses", false, "Embed the license and notice files of all modules into the busybox, printed by 'bb --licenses'")
+	failOnSkew    = flag.Bool("fail-on-version-skew", false, "Fail if a command would be built with another major or minor version of a module than its go.mod requires")
+	configPath    = flag.String("config", "", "JSON file of command groups to build one busybox each of, instead of the commands in the arguments and -o")
+	targetList    = flag.String("targets", "", "Comma-separated GOOS/GOARCH platforms to build for, e.g. linux/amd64,linux/arm64; output paths are then templates (default -o bb-{{.GOOS}}-{{.GOARCH}})")
 )
 
+// config is the contents of a -config file, e.g.
+//
+//	{"groups": [
+//		{"name": "early", "output": "bb-early-{{.GOARCH}}", "commands": ["./cmds/init", "./cmds/ls"]},
+//		{"name": "full", "output": "bb-{{.GOARCH}}", "commands": ["./cmds/..."]}
+//	],
+//	"targets": ["linux/amd64", "linux/arm64"]}
+//
+// Command and output paths are relative to the current directory. Targets are
+// the same as -targets.
+type config struct {
+	Groups  []bb.Group `json:"groups"`
+	Targets []string   `json:"targets"`
+}
+
+func readConfig(path string) (*config, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var c config
+	if err := json.Unmarshal(data, &c); err != nil {
+		return nil, fmt.Errorf("parsing %s failed: %v", path, err)
+	}
+	for i, g := range c.Groups {
+		if c.Groups[i].BinaryPath, err = filepath.Abs(g.BinaryPath); err != nil {
+			return nil, err
+		}
+	}
+	return &c, nil
+}
+
 func main() {
 	bopts := &golang.BuildOpts{}
 	bopts.RegisterFlags(flag.CommandLine)
 	env := golang.Default()
 	env.RegisterFlags(flag.CommandLine)
+	var aliasFlags uflag.Strings
+	flag.Var(&aliasFlags, "alias", "Additional name for a command as alias=command, e.g. gunzip=gzip (may be repeated)")
 	flag.Parse()
 
 	// Why doesn't the log package export this as a default?
 	l := log.New(os.Stdout, "", log.Ltime)
 
-	o, err := filepath.Abs(*outputPath)
-	if err != nil {
-		l.Fatal(err)
+	var oSet bool
+	flag.Visit(func(f *flag.Flag) {
+		oSet = oSet || f.Name == "o"
+	})
+	var targetNames []string
+	if *targetList != "" {
+		targetNames = strings.Split(*targetList, ",")
+	}
+	out := *outputPath
+	outputs := []string{out}
+	var groups []bb.Group
+	if *configPath != "" {
+		if oSet {
+			l.Fatalf("-o cannot be combined with -config")
+		}
+		if flag.NArg() > 0 {
+			l.Fatalf("Commands cannot be given both as arguments and in -config")
+		}
+		c, err := readConfig(*configPath)
+		if err != nil {
+			l.Fatalf("Reading -config failed: %v", err)
+		}
+		if len(c.Targets) > 0 && len(targetNames) > 0 {
+			l.Fatalf("-targets cannot be combined with targets in -config")
+		} else if len(c.Targets) > 0 {
+			targetNames = c.Targets
+		}
+		groups, out, outputs = c.Groups, "", nil
+		for _, g := range groups {
+			outputs = append(outputs, g.BinaryPath)
+		}
+	} else if len(targetNames) > 0 && !oSet {
+		out = "bb-{{.GOOS}}-{{.GOARCH}}"
+		outputs = []string{out}
+	}
+	var targets []bb.Target
+	for _, name := range targetNames {
+		t, err := bb.ParseTarget(name)
+		if err != nil {
+			l.Fatal(err)
+		}
+		targets = append(targets, t)
+	}
+	o := out
+	if o != "" {
+		var err error
+		if o, err = filepath.Abs(o); err != nil {
+			l.Fatal(err)
+		}
 	}
 
 	if env.CgoEnabled {
@@ -44,8 +144,7 @@ func main() {
 		env.CgoEnabled = false
 	}
 
-	err = env.CompilerInit()
-	if err != nil {
+	if err := env.CompilerInit(); err != nil {
 		l.Fatal(err)
 	}
 
@@ -63,18 +162,46 @@ func main() {
 		remove = true
 	}
 
+	aliases := make(map[string]string)
+	for _, a := range aliasFlags {
+		alias, name, ok := strings.Cut(a, "=")
+		if !ok {
+			l.Fatalf("Invalid -alias %q, want alias=command", a)
+		}
+		aliases[alias] = name
+	}
+
 	opts := &bb.Opts{
-		Env:          env,
-		GenSrcDir:    tmpDir,
-		CommandPaths: flag.Args(),
-		BinaryPath:   o,
-		GoBuildOpts:  bopts,
-		GenerateOnly: *genOnly,
+		Env:               env,
+		GenSrcDir:         tmpDir,
+		ReuseGenSrcDir:    *reuseGenDir,
+		CacheDir:          *cacheDir,
+		Jobs:              *jobs,
+		CommandPaths:      flag.Args(),
+		BinaryPath:        o,
+		Groups:            groups,
+		Targets:           targets,
+		GoBuildOpts:       bopts,
+		GenerateOnly:      *genOnly,
+		RewriteDeps:       *rewriteDep,
+		InterceptExits:    *interceptExit,
+		InterceptStdio:    *interceptIO,
+		BuildInfo:         *buildInfo,
+		ModuleMode:        *moduleMode,
+		Aliases:           aliases,
+		ManifestPath:      *manifest,
+		SPDXPath:          *spdx,
+		CycloneDXPath:     *cyclonedx,
+		NoticePath:        *notice,
+		EmbedLicenses:     *embedLicenses,
+		FailOnVersionSkew: *failOnSkew,
 	}
 	if err := bb.BuildBusybox(l, opts); err != nil {
 		l.Fatalf("Preserving bb generated source directory at %s due to error: %v", tmpDir, err)
 		// Only remove temp dir if there was no error.
 		remove = false
+	} else if opts.GenerateOnly && len(targets) > 0 {
+		l.Printf("Generated source can be found in %s/<GOOS>_<GOARCH>. `cd %s && go build` to build.", tmpDir, filepath.Join(tmpDir, "<GOOS>_<GOARCH>/src/bb.u-root.com/bb"))
 	} else if opts.GenerateOnly {
 		l.Printf("Generated source can be found in %s. `cd %s && go build` to build.", tmpDir, filepath.Join(tmpDir, "src/bb.u-root.com/bb"))
 	}
@@ -84,15 +211,27 @@ func main() {
 		l.Printf("Keeping temp dir %v", tmpDir)
 	}
 
-	path := *outputPath
-	if stat, err := os.Stat(path); err == nil {
-		if stat.IsDir() {
-			path = filepath.Join(path, "bb")
-			stat, err = os.Stat(path)
-			if err != nil {
-				return
+	if len(targets) > 0 {
+		var paths []string
+		for _, t := range targets {
+			for _, path := range outputs {
+				// Templates were checked by BuildBusybox.
+				path, _ := t.Expand(path)
+				paths = append(paths, path)
+			}
+		}
+		outputs = paths
+	}
+	for _, path := range outputs {
+		if stat, err := os.Stat(path); err == nil {
+			if stat.IsDir() {
+				path = filepath.Join(path, "bb")
+				stat, err = os.Stat(path)
+				if err != nil {
+					continue
+				}
 			}
+			l.Printf("Successfully built %q (size %d bytes -- %s).", path, stat.Size(), humanize.IBytes(uint64(stat.Size())))
 		}
-		l.Printf("Successfully built %q (size %d bytes -- %s).", path, stat.Size(), humanize.IBytes(uint64(stat.Size())))
 	}
 }
@@ -7,8 +7,7 @@ require (
 	github.com/hashicorp/go-version v1.6.0
 	github.com/u-root/uio v0.0.0-20210528151154-e40b768296a7
 	golang.org/x/exp v0.0.0-20240222234643-814bf88cf225
+	golang.org/x/mod v0.15.0
 	golang.org/x/tools v0.18.0
 	mvdan.cc/sh/v3 v3.7.0
 )
-
-require golang.org/x/mod v0.15.0 // indirect
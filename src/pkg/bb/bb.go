@@ -24,13 +24,19 @@
 package bb
 
 import (
+	"errors"
 	"fmt"
 	"io/ioutil"
 	"os"
 	"path/filepath"
+	"runtime"
+	"sort"
 	"strings"
+	"sync"
+	"time"
 
 	"golang.org/x/exp/maps"
+	"golang.org/x/mod/module"
 	"golang.org/x/tools/go/ast/astutil"
 	"golang.org/x/tools/go/packages"
 
@@ -52,13 +58,39 @@ func checkDuplicate(cmds []*bbinternal.Package) error {
 	seen := make(map[string]string)
 	for _, cmd := range cmds {
 		if path, ok := seen[cmd.Name]; ok {
-			return fmt.Errorf("failed to build with bb: found duplicate command %s (%s and %s)", cmd.Name, path, cmd.Pkg.PkgPath)
+			return fmt.Errorf("failed to build with bb: found duplicate command %s (%s and %s); name one of them explicitly with name=path", cmd.Name, path, cmd.Pkg.PkgPath)
 		}
 		seen[cmd.Name] = cmd.Pkg.PkgPath
 	}
 	return nil
 }
 
+// addAliases adds the aliases, mapping alias to command name, to cmds.
+func addAliases(cmds []*bbinternal.Package, aliases map[string]string) error {
+	byName := make(map[string]*bbinternal.Package)
+	for _, cmd := range cmds {
+		byName[cmd.Name] = cmd
+	}
+	// Sort for deterministic output.
+	names := maps.Keys(aliases)
+	sort.Strings(names)
+	for _, alias := range names {
+		name := aliases[alias]
+		if alias == "" || strings.ContainsRune(alias, '/') {
+			return fmt.Errorf("failed to build with bb: invalid alias %q for command %s", alias, name)
+		}
+		if cmd, ok := byName[alias]; ok {
+			return fmt.Errorf("failed to build with bb: alias %s for command %s conflicts with command %s (%s)", alias, name, alias, cmd.Pkg.PkgPath)
+		}
+		cmd, ok := byName[name]
+		if !ok {
+			return fmt.Errorf("failed to build with bb: alias %s refers to unknown command %s", alias, name)
+		}
+		cmd.Aliases = append(cmd.Aliases, alias)
+	}
+	return nil
+}
+
 // Opts are the arguments to BuildBusybox.
 type Opts struct {
 	// Env are the environment variables used in Go compilation and package
@@ -82,13 +114,80 @@ type Opts struct {
 	// In GOPATH mode, GOPATH=GenSrcDir for compilation.
 	GenSrcDir string
 
+	// ReuseGenSrcDir allows GenSrcDir to contain the source generated by
+	// a previous build, which is removed and generated again. A stable
+	// GenSrcDir keeps file paths, and with them Go build cache entries,
+	// the same across builds.
+	//
+	// BuildBusybox still returns an error if GenSrcDir contains anything
+	// else.
+	ReuseGenSrcDir bool
+
+	// Jobs is the number of packages rewritten or copied in parallel. If
+	// it is not positive, GOMAXPROCS packages are.
+	//
+	// The generated source does not depend on it. If several packages
+	// fail, the errors of all of them are returned.
+	Jobs int
+
+	// CacheDir is a directory to cache rewritten commands and copied
+	// dependency packages in across builds. Packages whose sources and
+	// dependencies have not changed are copied from the cache instead of
+	// being rewritten again.
+	//
+	// Entries are keyed on the contents of the packages' and their
+	// dependencies' source files, the options they were written with,
+	// the Go version, GOOS, GOARCH and build tags, and the running
+	// executable. Dependency packages that are copied rather than
+	// rewritten are only keyed on their own files, so platforms share
+	// them. The directory may be removed at any time.
+	CacheDir string
+
 	// CommandPaths is a list of file system directories containing Go
 	// commands, or Go import paths.
+	//
+	// See findpkg.NewPackages for the allowed formats, including
+	// name=path to name a command explicitly, and for how commands in
+	// GOPATH and in modules are mixed.
 	CommandPaths []string
 
+	// CommandNames maps command names to a file system directory or Go
+	// import path of one command each, for commands that are not to be
+	// named after their directory, e.g. to resolve collisions.
+	//
+	// It is equivalent to name=path in CommandPaths.
+	CommandNames map[string]string
+
 	// BinaryPath is the file to write the binary to.
 	BinaryPath string
 
+	// Groups builds several busyboxes at once instead of one of
+	// CommandPaths, CommandNames and BinaryPath, which must then be
+	// unset.
+	//
+	// The commands of all groups are looked up, rewritten and copied
+	// once, into one generated tree, and each group gets its own main
+	// package in it. Commands must have unique names across all
+	// groups, and Aliases apply to a command in every group that has it.
+	Groups []Group
+
+	// Targets builds the busyboxes for each of several platforms instead
+	// of Env's GOOS and GOARCH only.
+	//
+	// BinaryPath, the BinaryPaths of Groups and the paths of manifests,
+	// notices and SBOMs are text/templates then, executed with each
+	// Target, e.g. bb-{{.GOOS}}-{{.GOARCH}}, and must differ between
+	// targets. Commands are looked up for each target, as build
+	// constraints may select other files. With GenSrcDir, each target's
+	// source is generated in GenSrcDir/<GOOS>_<GOARCH>.
+	//
+	// Copied dependency packages whose files are the same for several
+	// targets are copied once and shared through CacheDir, or a temporary
+	// cache if it is unset. Rewritten packages depend on the target's
+	// types, so they are rewritten for each target, but targets for which
+	// they are rewritten the same share their files in the cache.
+	Targets []Target
+
 	// GoBuildOpts is configuration for the `go build` command that
 	// compiles the busybox binary.
 	GoBuildOpts *golang.BuildOpts
@@ -96,6 +195,152 @@ type Opts struct {
 	// Generate the tree but don't build it. This is useful for systems
 	// like Tamago which have their own way of building.
 	GenerateOnly bool
+
+	// RewriteDeps defers the init functions and global variable
+	// initializers of non-standard-library dependency packages, so that
+	// they only run when a command that depends on them is invoked.
+	//
+	// Packages whose initialization cannot be deferred (e.g. because they
+	// contain assembly) and all of their dependencies are initialized at
+	// busybox startup as usual.
+	RewriteDeps bool
+
+	// InterceptExits rewrites calls in commands that exit the process,
+	// i.e. os.Exit, log.Fatal* and flag parsing with flag.ExitOnError,
+	// into calls to bbmain. Commands may then be run without exiting the
+	// busybox with bbmain.RunInProcess, which returns the exit code.
+	InterceptExits bool
+
+	// InterceptStdio rewrites references in commands to os.Stdin, os.Stdout
+	// and os.Stderr, as well as fmt.Print*, to use bbmain's standard I/O.
+	// With InterceptExits, commands may then be run with their own
+	// arguments and standard I/O with bbmain.Exec.
+	InterceptStdio bool
+
+	// BuildInfo records the build info `go install` would give each
+	// command, including the version control settings of its Git
+	// checkout, and rewrites calls to debug.ReadBuildInfo in commands to
+	// return it. Otherwise, commands get the busybox's build info.
+	BuildInfo bool
+
+	// ModuleMode generates the busybox as a Go module and builds it with
+	// modules enabled, rather than in GOPATH mode.
+	//
+	// The generated bb.u-root.com/bb module requires the modules of all
+	// dependencies at the versions selected for the commands, verified by
+	// their go.sum entries. Modules containing commands or rewritten
+	// packages are copied into GenSrcDir/src and replaced by those copies.
+	// All commands must be in modules.
+	ModuleMode bool
+
+	// Aliases maps additional command names to the names of commands in
+	// the busybox, e.g. "gunzip" to "gzip". Aliases are registered with
+	// the same init and main functions as their command, which can tell
+	// them apart by os.Args[0].
+	Aliases map[string]string
+
+	// FailOnVersionSkew fails the build if a command's dependencies
+	// would come from a module at another major or minor version than
+	// the command's go.mod requires, e.g. because another command in the
+	// same Go workspace requires a newer one.
+	//
+	// Such differences are logged either way.
+	FailOnVersionSkew bool
+
+	// ManifestPath is a file to write the busybox's Manifest to as JSON,
+	// describing its commands, dependency packages and modules, and the
+	// Go version and flags it was built with.
+	//
+	// The manifest is written if the busybox was generated and, unless
+	// GenerateOnly is set, built successfully.
+	ManifestPath string
+
+	// SPDXPath and CycloneDXPath are files to write software bills of
+	// materials of the busybox to, in SPDX 2.3 and CycloneDX 1.5 JSON
+	// format. They are derived from the Manifest, with the busybox named
+	// after BinaryPath as the top-level component and each command as a
+	// sub-component. Module licenses are detected from their license
+	// files where possible.
+	//
+	// The creation time is taken from SOURCE_DATE_EPOCH if set.
+	SPDXPath      string
+	CycloneDXPath string
+
+	// NoticePath is a file to write the license and notice files of all
+	// modules in the busybox to, i.e. the LICENSE, LICENCE, COPYING and
+	// NOTICE files in each module's root directory, each module with
+	// the SPDX identifiers detected from its license files.
+	NoticePath string
+
+	// EmbedLicenses embeds the same notice into the busybox, which prints
+	// it when invoked as `bb --licenses`.
+	EmbedLicenses bool
+}
+
+// Group is one of several busyboxes built together.
+type Group struct {
+	// Name names the group's main package in the generated tree,
+	// bb.u-root.com/bb/cmd/<Name>, and is inserted into the file names of
+	// the group's manifest, notice and SBOMs, e.g. bb-<Name>.spdx.json.
+	Name string `json:"name"`
+
+	// CommandPaths are the group's commands, in the formats allowed by
+	// Opts.CommandPaths.
+	CommandPaths []string `json:"commands"`
+
+	// BinaryPath is the file to write the group's busybox to.
+	BinaryPath string `json:"output"`
+}
+
+// groups returns the groups of busyboxes to build for opts: opts.Groups, or a
+// single unnamed group of CommandPaths and CommandNames.
+func (opts *Opts) groups() ([]Group, error) {
+	if len(opts.Groups) == 0 {
+		patterns := append([]string(nil), opts.CommandPaths...)
+		// Sort for deterministic output.
+		names := maps.Keys(opts.CommandNames)
+		sort.Strings(names)
+		for _, name := range names {
+			patterns = append(patterns, name+"="+opts.CommandNames[name])
+		}
+		return []Group{{CommandPaths: patterns, BinaryPath: opts.BinaryPath}}, nil
+	}
+	if len(opts.CommandPaths) > 0 || len(opts.CommandNames) > 0 || opts.BinaryPath != "" {
+		return nil, fmt.Errorf("command groups cannot be combined with command paths, command names or a binary path")
+	}
+	seen := make(map[string]struct{})
+	for _, g := range opts.Groups {
+		if strings.ContainsAny(g.Name, `/\`) || module.CheckImportPath(g.Name) != nil {
+			return nil, fmt.Errorf("invalid command group name %q", g.Name)
+		}
+		if _, ok := seen[g.Name]; ok {
+			return nil, fmt.Errorf("duplicate command group %s", g.Name)
+		}
+		seen[g.Name] = struct{}{}
+	}
+	return opts.Groups, nil
+}
+
+// mainDir returns the directory of g's main package in bbDir.
+func (g Group) mainDir(bbDir string) string {
+	if g.Name == "" {
+		return bbDir
+	}
+	return filepath.Join(bbDir, "cmd", g.Name)
+}
+
+// path inserts g's name into the file name of path before its extensions,
+// e.g. bb.spdx.json becomes bb-<Name>.spdx.json.
+func (g Group) path(path string) string {
+	if g.Name == "" || path == "" {
+		return path
+	}
+	dir, base := filepath.Split(path)
+	i := strings.Index(base, ".")
+	if i <= 0 {
+		i = len(base)
+	}
+	return filepath.Join(dir, base[:i]+"-"+g.Name+base[i:])
 }
 
 // BuildBusybox builds a busybox of many Go commands. opts contains both the
@@ -111,6 +356,9 @@ func BuildBusybox(l ulog.Logger, opts *Opts) (nerr error) {
 	} else if err := opts.Env.Valid(); err != nil {
 		return err
 	}
+	if len(opts.Targets) > 0 {
+		return buildTargets(l, opts)
+	}
 
 	var tmpDir string
 	if opts.GenSrcDir != "" {
@@ -123,8 +371,13 @@ func BuildBusybox(l ulog.Logger, opts *Opts) (nerr error) {
 			relTmpDir = opts.GenSrcDir
 		} else if err != nil {
 			return fmt.Errorf("could not read directory supplied for busybox generated source: %w", err)
-		} else if len(dirents) > 0 {
+		} else if len(dirents) > 0 && !opts.ReuseGenSrcDir {
 			return fmt.Errorf("directory supplied for busybox generated source is not an empty directory")
+		} else if len(dirents) > 0 {
+			if err := clearGenSrcDir(opts.GenSrcDir); err != nil {
+				return err
+			}
+			relTmpDir = opts.GenSrcDir
 		} else {
 			relTmpDir = opts.GenSrcDir
 		}
@@ -164,11 +417,34 @@ func BuildBusybox(l ulog.Logger, opts *Opts) (nerr error) {
 		lookupEnv = findpkg.DefaultEnv()
 	}
 
+	groups, err := opts.groups()
+	if err != nil {
+		return err
+	}
+	patterns := make([][]string, 0, len(groups))
+	for _, g := range groups {
+		patterns = append(patterns, g.CommandPaths)
+	}
+
 	// Ask go about all the commands in one batch for dependency caching.
-	cmds, err := findpkg.NewPackages(l, opts.Env, lookupEnv, opts.CommandPaths...)
+	groupCmds, err := findpkg.NewPackageGroups(l, opts.Env, lookupEnv, patterns...)
 	if err != nil {
 		return fmt.Errorf("finding packages failed: %v", err)
 	}
+	// Commands of several groups are rewritten once.
+	var cmds []*bbinternal.Package
+	seen := make(map[*bbinternal.Package]struct{})
+	for i, g := range groups {
+		if len(groupCmds[i]) == 0 && g.Name != "" {
+			return fmt.Errorf("no valid commands given for command group %s", g.Name)
+		}
+		for _, cmd := range groupCmds[i] {
+			if _, ok := seen[cmd]; !ok {
+				seen[cmd] = struct{}{}
+				cmds = append(cmds, cmd)
+			}
+		}
+	}
 	if len(cmds) == 0 {
 		return fmt.Errorf("no valid commands given")
 	}
@@ -177,60 +453,236 @@ func BuildBusybox(l ulog.Logger, opts *Opts) (nerr error) {
 	if err := checkDuplicate(cmds); err != nil {
 		return err
 	}
+	if err := addAliases(cmds, opts.Aliases); err != nil {
+		return err
+	}
 
-	modules := make(map[string]struct{})
-	var numNoModule int
+	var numModule, numNoModule int
 	for _, cmd := range cmds {
 		if cmd.Pkg.Module != nil {
-			modules[cmd.Pkg.Module.Path] = struct{}{}
+			numModule++
 		} else {
 			numNoModule++
 		}
 	}
-	if len(modules) > 0 && numNoModule > 0 {
-		return fmt.Errorf("gobusybox does not support mixed module/non-module compilation -- commands contain main modules %v", strings.Join(maps.Keys(modules), ", "))
+	if opts.ModuleMode && numNoModule > 0 {
+		return fmt.Errorf("module mode requires all commands to be in Go modules")
+	}
+
+	// Without -trimpath, file names in the binary are absolute, so they
+	// may as well point at the original sources.
+	lines := bbinternal.LineDirectivesRelative
+	if opts.GoBuildOpts != nil && opts.GoBuildOpts.NoTrimPath {
+		lines = bbinternal.LineDirectivesAbsolute
+	}
+
+	if opts.BuildInfo {
+		var infos buildInfos
+		for _, cmd := range cmds {
+			info, err := infos.buildInfo(cmd.Pkg)
+			if err != nil {
+				return fmt.Errorf("reading build info of %s failed: %v", cmd.Pkg.PkgPath, err)
+			}
+			cmd.BuildInfo = info.String()
+		}
+	}
+	if err := checkVersionSkews(l, cmds, opts.FailOnVersionSkew); err != nil {
+		return err
+	}
+
+	// Collect and write dependencies into pkgDir.
+	goroot, err := opts.Env.GoRoot()
+	if err != nil {
+		return err
+	}
+	// GOPATH and module commands are looked up separately, so they may
+	// disagree on packages.
+	if err := checkImportPathConflicts(cmds, goroot); err != nil {
+		return err
+	}
+	allDeps := collectAllDeps(cmds, goroot)
+	deps := allDeps
+	if numModule > 0 && numNoModule > 0 {
+		logOrigins(l, cmds, allDeps)
+	}
+	if err := checkLangVersions(l, opts.Env, cmds, deps); err != nil {
+		return err
+	}
+	rewrittenDeps := make(map[string]*bbinternal.Package)
+	if opts.RewriteDeps {
+		rewrittenDeps = deferredDeps(l, deps, lines)
+	}
+	var mods *moduleTree
+	if opts.ModuleMode {
+		mods, err = newModuleTree(cmds, deps, rewrittenDeps)
+		if err != nil {
+			return err
+		}
+		// Other modules are used as they are.
+		deps = mods.localPackages(deps)
+	}
+	var cache *rewriteCache
+	if opts.CacheDir != "" {
+		cache, err = newRewriteCache(opts.CacheDir, opts.Env, goroot)
+		if err != nil {
+			return fmt.Errorf("opening cache failed: %v", err)
+		}
+	}
+	if err := writeDeps(cache, opts.Jobs, pkgDir, deps, rewrittenDeps, lines); err != nil {
+		return fmt.Errorf("collecting and putting dependencies in place failed: %w", err)
 	}
 
-	// List of packages to import in the real main file.
-	var bbImports []string
 	// Rewrite commands to packages.
-	for _, cmd := range cmds {
+	if err := forEach(opts.Jobs, len(cmds), func(i int) error {
+		cmd := cmds[i]
 		destination := filepath.Join(pkgDir, cmd.Pkg.PkgPath)
 
-		if err := cmd.Rewrite(destination, "bb.u-root.com/bb/pkg/bbmain"); err != nil {
+		cmd.SetRewrittenDeps(rewrittenDeps)
+		cmd.LineDirectives = lines
+		cmd.InterceptExits = opts.InterceptExits
+		cmd.InterceptStdio = opts.InterceptStdio
+		options := append([]string{
+			"cmd", cmd.Name, strings.Join(cmd.Aliases, ","), cmd.GODEBUG, cmd.BuildInfo,
+			fmt.Sprint(lines, cmd.InterceptExits, cmd.InterceptStdio), bbmainImportPath,
+		}, rewrittenImports(cmd.Pkg, rewrittenDeps)...)
+		if err := cache.write(cmd.Pkg, destination, options, func(dir string) error {
+			return cmd.Rewrite(dir, bbmainImportPath)
+		}); err != nil {
 			return fmt.Errorf("rewriting command %q failed: %v", cmd.Pkg.PkgPath, err)
 		}
-		bbImports = append(bbImports, cmd.Pkg.PkgPath)
+		return nil
+	}); err != nil {
+		return err
+	}
+	if cache != nil {
+		l.Printf("Reused %d of %d packages from cache %s, %d others were written the same as cached ones", cache.hits, cache.hits+cache.misses, opts.CacheDir, cache.shared)
 	}
 
-	// Collect and write dependencies into pkgDir.
-	if err := copyAllDeps(l, opts.Env, bbDir, tmpDir, pkgDir, cmds); err != nil {
-		return fmt.Errorf("collecting and putting dependencies in place failed: %v", err)
+	buildEnv := opts.Env.Copy(golang.WithGO111MODULE("off"), golang.WithGOPATH(tmpDir), golang.WithMod(""))
+	if mods != nil {
+		buildEnv = opts.Env.Copy(golang.WithGO111MODULE("on"), golang.WithGOWORK("off"), golang.WithMod(golang.ModReadonly), golang.WithoutModuleGOFLAGS())
+	}
+	godebug, err := godebugDirective(opts.Env)
+	if err != nil {
+		return err
 	}
+	if err := writeBBRegister(bbDir); err != nil {
+		return fmt.Errorf("failed to write register.go: %v", err)
+	}
+	manifests := make([]*Manifest, len(groups))
+	for i, g := range groups {
+		mainDir := g.mainDir(bbDir)
+		if opts.ManifestPath != "" || opts.SPDXPath != "" || opts.CycloneDXPath != "" || opts.NoticePath != "" || opts.EmbedLicenses {
+			manifests[i], err = newManifest(buildEnv, opts.GoBuildOpts, mods != nil, groupCmds[i], collectAllDeps(groupCmds[i], goroot), rewrittenDeps)
+			if err != nil {
+				return fmt.Errorf("creating manifest failed: %v", err)
+			}
+		}
 
-	if err := writeBBMain(bbDir, tmpDir, bbImports); err != nil {
-		return fmt.Errorf("failed to write main.go: %v", err)
+		// List of packages to import in the real main file.
+		bbImports := make([]string, 0, len(groupCmds[i]))
+		for _, cmd := range groupCmds[i] {
+			bbImports = append(bbImports, cmd.Pkg.PkgPath)
+		}
+		if err := writeBBMain(mainDir, bbImports, godebug); err != nil {
+			return fmt.Errorf("failed to write main.go: %v", err)
+		}
+		if opts.EmbedLicenses {
+			notice, err := manifests[i].notice()
+			if err != nil {
+				return fmt.Errorf("collecting licenses failed: %v", err)
+			}
+			if err := writeLicensesSource(mainDir, notice); err != nil {
+				return fmt.Errorf("failed to write licenses.go: %v", err)
+			}
+		}
+	}
+	if mods != nil {
+		if err := mods.write(bbDir, pkgDir); err != nil {
+			return fmt.Errorf("failed to write go.mod: %v", err)
+		}
 	}
 
-	if opts.GenerateOnly {
+	// Get ready to compile bb.
+	for i, g := range groups {
+		if !opts.GenerateOnly {
+			mainDir := g.mainDir(bbDir)
+			if err := buildEnv.BuildDir(mainDir, g.BinaryPath, opts.GoBuildOpts); err != nil {
+				e := &ErrBuild{
+					CmdDir: mainDir,
+					Err:    err,
+				}
+				if mods == nil {
+					e.GOPATH = tmpDir
+				}
+				return e
+			}
+		}
+
+		if manifests[i] != nil {
+			if err := writeManifests(opts, g, manifests[i]); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// writeManifests writes the manifest m of group g, the notice file and SBOMs
+// derived from it to the files given in opts.
+func writeManifests(opts *Opts, g Group, m *Manifest) error {
+	if opts.ManifestPath != "" {
+		if err := writeManifest(g.path(opts.ManifestPath), m); err != nil {
+			return fmt.Errorf("writing manifest failed: %v", err)
+		}
+	}
+	if opts.NoticePath != "" {
+		notice, err := m.notice()
+		if err != nil {
+			return fmt.Errorf("collecting licenses failed: %v", err)
+		}
+		if err := os.WriteFile(g.path(opts.NoticePath), notice, 0o644); err != nil {
+			return fmt.Errorf("writing notice file failed: %v", err)
+		}
+	}
+	if opts.SPDXPath == "" && opts.CycloneDXPath == "" {
 		return nil
 	}
 
-	// Get ready to compile bb.
-	buildEnv := opts.Env.Copy(golang.WithGO111MODULE("off"), golang.WithGOPATH(tmpDir), golang.WithMod(""))
-	if err := buildEnv.BuildDir(bbDir, opts.BinaryPath, opts.GoBuildOpts); err != nil {
-		return &ErrBuild{
-			CmdDir: bbDir,
-			GOPATH: tmpDir,
-			Err:    err,
+	name := "bb"
+	if g.BinaryPath != "" {
+		name = filepath.Base(g.BinaryPath)
+	}
+	created, err := sbomTime()
+	if err != nil {
+		return err
+	}
+	for _, sbom := range []struct {
+		path   string
+		format string
+		gen    func(string, time.Time) ([]byte, error)
+	}{
+		{g.path(opts.SPDXPath), "SPDX", m.SPDX},
+		{g.path(opts.CycloneDXPath), "CycloneDX", m.CycloneDX},
+	} {
+		if sbom.path == "" {
+			continue
+		}
+		data, err := sbom.gen(name, created)
+		if err != nil {
+			return fmt.Errorf("creating %s SBOM failed: %v", sbom.format, err)
+		}
+		if err := os.WriteFile(sbom.path, data, 0o644); err != nil {
+			return fmt.Errorf("writing %s SBOM failed: %v", sbom.format, err)
 		}
 	}
 	return nil
 }
 
-// ErrBuild is returned for a go build failure when modules were disabled.
+// ErrBuild is returned for a go build failure.
 type ErrBuild struct {
 	CmdDir string
+	// GOPATH is set when modules were disabled.
 	GOPATH string
 	Err    error
 }
@@ -242,31 +694,49 @@ func (e *ErrBuild) Unwrap() error {
 
 // Error implements error.Error.
 func (e *ErrBuild) Error() string {
+	if e.GOPATH == "" {
+		return fmt.Sprintf("`(cd %s && GOWORK=off go build -mod=readonly)` failed: %v", e.CmdDir, e.Err)
+	}
 	return fmt.Sprintf("`(cd %s && GOPATH=%s GO111MODULE=off go build)` failed: %v", e.CmdDir, e.GOPATH, e.Err)
 }
 
-// writeBBMain writes $TMPDIR/src/bb.u-root.com/bb/pkg/bbmain/register.go and
-// $TMPDIR/src/bb.u-root.com/bb/main.go.
-//
-// They are taken from ./bbmain/register.go and ./bbmain/cmd/main.go, but they
-// do not retain their original import paths because the main command must be
-// in a module that doesn't conflict with any bb commands. If one were to
-// compile github.com/u-root/gobusybox/src/cmd/* into a busybox, we'd have
-// problems -- the src/go.mod would conflict with our generated go.mod, and
-// it'd be complicated to merge them. So they are transplanted into the
-// bb.u-root.com/bb module.
-func writeBBMain(bbDir, tmpDir string, bbImports []string) error {
+// bbmainImportPath is the import path of bbmain in the generated busybox.
+const bbmainImportPath = "bb.u-root.com/bb/pkg/bbmain"
+
+// writeBBRegister writes $TMPDIR/src/bb.u-root.com/bb/pkg/bbmain/register.go,
+// taken from ./bbmain/register.go. See writeBBMain for why.
+func writeBBRegister(bbDir string) error {
 	if err := os.MkdirAll(filepath.Join(bbDir, "pkg/bbmain"), 0755); err != nil {
 		return err
 	}
-	if err := ioutil.WriteFile(filepath.Join(bbDir, "pkg/bbmain/register.go"), bbRegisterSource, 0755); err != nil {
+	return ioutil.WriteFile(filepath.Join(bbDir, "pkg/bbmain/register.go"), bbRegisterSource, 0755)
+}
+
+// writeBBMain writes main.go into mainDir, $TMPDIR/src/bb.u-root.com/bb or a
+// command group's directory below it.
+//
+// It is taken from ./bbmain/cmd/main.go, but it does not retain its original
+// import path, nor does bbmain, because the main command must be in a module
+// that doesn't conflict with any bb commands. If one were to compile
+// github.com/u-root/gobusybox/src/cmd/* into a busybox, we'd have problems --
+// the src/go.mod would conflict with our generated go.mod, and it'd be
+// complicated to merge them. So they are transplanted into the
+// bb.u-root.com/bb module.
+//
+// directives are prepended to main.go.
+func writeBBMain(mainDir string, bbImports []string, directives string) error {
+	if err := os.MkdirAll(mainDir, 0755); err != nil {
 		return err
 	}
-	if err := ioutil.WriteFile(filepath.Join(bbDir, "main.go"), bbMainSource, 0755); err != nil {
+	mainSource := bbMainSource
+	if directives != "" {
+		mainSource = append([]byte(directives+"\n\n"), bbMainSource...)
+	}
+	if err := ioutil.WriteFile(filepath.Join(mainDir, "main.go"), mainSource, 0755); err != nil {
 		return err
 	}
 
-	bbFset, bbFiles, _, err := bbinternal.ParseAST("main", []string{filepath.Join(bbDir, "main.go")})
+	bbFset, bbFiles, _, err := bbinternal.ParseAST("main", []string{filepath.Join(mainDir, "main.go")})
 	if err != nil {
 		return err
 	}
@@ -274,36 +744,275 @@ func writeBBMain(bbDir, tmpDir string, bbImports []string) error {
 		return fmt.Errorf("bb package not found")
 	}
 
-	// Fix the import path for bbmain, since we wrote bbmain/register.go into bbDir above.
-	if !astutil.RewriteImport(bbFset, bbFiles[0], "github.com/u-root/gobusybox/src/pkg/bb/bbmain", "bb.u-root.com/bb/pkg/bbmain") {
+	// Fix the import path for bbmain, since we wrote bbmain/register.go into bbDir.
+	if !astutil.RewriteImport(bbFset, bbFiles[0], "github.com/u-root/gobusybox/src/pkg/bb/bbmain", bbmainImportPath) {
 		return fmt.Errorf("could not rewrite import")
 	}
 
 	// Create bb main.go.
-	if err := bbinternal.CreateBBMainSource(bbFset, bbFiles, bbImports, bbDir); err != nil {
+	if err := bbinternal.CreateBBMainSource(bbFset, bbFiles, bbImports, mainDir); err != nil {
 		return fmt.Errorf("creating bb main.go file failed: %v", err)
 	}
 	return nil
 }
 
-func copyAllDeps(l ulog.Logger, env *golang.Environ, bbDir, tmpDir, pkgDir string, mainPkgs []*bbinternal.Package) error {
+// godebugDirective returns a //go:debug directive for the busybox's main
+// package that gives it the default GODEBUG settings of the compiler, on top
+// of which commands apply their own with bbmain.RegisterGODEBUG. Otherwise, the
+// busybox would have the default settings of its go version, e.g. Go 1.20 in
+// GOPATH mode.
+//
+// The directive is supported by Go 1.23 and later.
+func godebugDirective(env *golang.Environ) (string, error) {
+	version, err := env.Version()
+	if err != nil {
+		return "", err
+	}
+	lang := bbinternal.Lang(version)
+	if env.Compiler.Type != golang.CompilerGo || lang == "" || bbinternal.CompareLang(lang, "go1.23") < 0 {
+		return "", nil
+	}
+	return "//go:debug default=" + lang, nil
+}
+
+// checkImportPathConflicts returns an error if different packages of cmds
+// have the same import path, e.g. a GOPATH package and a package of a module
+// with the same path. Only one of them could be written into the generated
+// tree.
+func checkImportPathConflicts(cmds []*bbinternal.Package, goroot string) error {
+	// Packages by import path and directory.
+	pkgs := make(map[string]map[string]*packages.Package)
+	for _, cmd := range cmds {
+		for _, p := range collectDeps(cmd.Pkg, goroot) {
+			if pkgs[p.PkgPath] == nil {
+				pkgs[p.PkgPath] = make(map[string]*packages.Package)
+			}
+			pkgs[p.PkgPath][packageDir(p)] = p
+		}
+	}
+
+	var errs []error
+	paths := maps.Keys(pkgs)
+	sort.Strings(paths)
+	for _, path := range paths {
+		if len(pkgs[path]) < 2 {
+			continue
+		}
+		var origins []string
+		for _, p := range pkgs[path] {
+			origins = append(origins, origin(p))
+		}
+		sort.Strings(origins)
+		errs = append(errs, fmt.Errorf("package %s is in %s", path, strings.Join(origins, " and ")))
+	}
+	if len(errs) > 0 {
+		return fmt.Errorf("conflicting packages with the same import path: %w", errors.Join(errs...))
+	}
+	return nil
+}
+
+// origin describes where package p comes from: its module or GOPATH, and its
+// directory.
+func origin(p *packages.Package) string {
+	if p.Module == nil {
+		return fmt.Sprintf("GOPATH (%s)", packageDir(p))
+	}
+	m := p.Module.Path
+	if p.Module.Version != "" {
+		m += "@" + p.Module.Version
+	}
+	return fmt.Sprintf("module %s (%s)", m, packageDir(p))
+}
+
+// logOrigins logs which of cmds and their dependencies deps come from GOPATH
+// and which from modules, for builds that mix both.
+func logOrigins(l ulog.Logger, cmds []*bbinternal.Package, deps []*packages.Package) {
+	pkgs := make([]*packages.Package, 0, len(cmds)+len(deps))
+	for _, cmd := range cmds {
+		pkgs = append(pkgs, cmd.Pkg)
+	}
+	pkgs = append(pkgs, deps...)
+
+	var gopath []string
+	modules := make(map[string]int)
+	for _, p := range pkgs {
+		if p.Module == nil {
+			gopath = append(gopath, p.PkgPath)
+		} else {
+			modules[p.Module.Path]++
+		}
+	}
+	sort.Strings(gopath)
+	l.Printf("Combining packages from GOPATH and Go modules")
+	l.Printf("From GOPATH: %s", strings.Join(gopath, " "))
+	paths := maps.Keys(modules)
+	sort.Strings(paths)
+	for _, path := range paths {
+		l.Printf("From module %s: %d packages", path, modules[path])
+	}
+}
+
+// collectAllDeps returns all non-standard-library dependencies of mainPkgs,
+// excluding mainPkgs themselves.
+func collectAllDeps(mainPkgs []*bbinternal.Package, goroot string) []*packages.Package {
 	var deps []*packages.Package
+	seenIDs := make(map[string]struct{})
+	// Commands are written by Rewrite.
 	for _, p := range mainPkgs {
-		deps = append(deps, collectDeps(p.Pkg)...)
+		seenIDs[p.Pkg.ID] = struct{}{}
 	}
+	for _, p := range mainPkgs {
+		for _, dep := range collectDeps(p.Pkg, goroot) {
+			if _, ok := seenIDs[dep.ID]; !ok {
+				deps = append(deps, dep)
+				seenIDs[dep.ID] = struct{}{}
+			}
+		}
+	}
+	return deps
+}
 
-	// Copy local dependency packages into module directories at
-	// tmpDir/src.
-	seenIDs := make(map[string]struct{})
+// checkLangVersions checks that the compiler supports the language versions
+// of the modules of cmds and deps.
+//
+// Written files are constrained to their module's language version, so files
+// of modules requiring a newer Go would silently be left out of the build.
+// Compilers before Go 1.21 ignore these constraints, compiling every module
+// with their own language version, which is logged as a warning.
+func checkLangVersions(l ulog.Logger, env *golang.Environ, cmds []*bbinternal.Package, deps []*packages.Package) error {
+	version, err := env.Version()
+	if err != nil {
+		return err
+	}
+	compilerLang := bbinternal.Lang(version)
+	if compilerLang == "" {
+		// Development versions are assumed to be new enough.
+		return nil
+	}
+
+	pkgs := make([]*packages.Package, 0, len(cmds)+len(deps))
+	for _, cmd := range cmds {
+		pkgs = append(pkgs, cmd.Pkg)
+	}
+	pkgs = append(pkgs, deps...)
+	older := make(map[string]struct{})
+	for _, p := range pkgs {
+		lang := bbinternal.LangVersion(p)
+		if lang == "" {
+			continue
+		}
+		switch c := bbinternal.CompareLang(lang, compilerLang); {
+		case c > 0:
+			return fmt.Errorf("module %s of package %s requires %s, but the compiler is %s", p.Module.Path, p.PkgPath, lang, version)
+		case c < 0:
+			older[p.Module.Path] = struct{}{}
+		}
+	}
+	if len(older) > 0 && bbinternal.CompareLang(compilerLang, "go1.21") < 0 {
+		paths := maps.Keys(older)
+		sort.Strings(paths)
+		l.Printf("Warning: %s does not support per-file language versions, so modules %s are compiled as %s rather than their declared Go version", version, strings.Join(paths, ", "), compilerLang)
+	}
+	return nil
+}
+
+// deferredDeps returns the dependencies whose initialization can be deferred
+// by rewriting them with bbinternal.Package.RewriteDep, by package ID, so that
+// commands can call their init functions.
+func deferredDeps(l ulog.Logger, deps []*packages.Package, lines bbinternal.LineDirectives) map[string]*bbinternal.Package {
+	// A package initialized at startup may use its dependencies in its
+	// initializers, so they have to be initialized at startup as well.
+	eager := make(map[string]struct{})
+	for _, p := range deps {
+		// Commands calling bbmain themselves use the busybox's bbmain,
+		// which is initialized at startup.
+		if p.PkgPath == "github.com/u-root/gobusybox/src/pkg/bb/bbmain" {
+			eager[p.ID] = struct{}{}
+			continue
+		}
+		if err := bbinternal.NewDepPackage(p).Deferrable(); err != nil {
+			l.Printf("Not deferring initialization of %s and its dependencies: %v", p.PkgPath, err)
+			packages.Visit([]*packages.Package{p}, nil, func(dep *packages.Package) {
+				eager[dep.ID] = struct{}{}
+			})
+		}
+	}
+
+	rewritten := make(map[string]*bbinternal.Package)
 	for _, p := range deps {
-		if _, ok := seenIDs[p.ID]; !ok {
-			if err := bbinternal.WritePkg(p, filepath.Join(pkgDir, p.PkgPath)); err != nil {
-				return fmt.Errorf("writing package %s failed: %v", p, err)
+		if _, ok := eager[p.ID]; !ok {
+			dep := bbinternal.NewDepPackage(p)
+			dep.LineDirectives = lines
+			rewritten[p.ID] = dep
+		}
+	}
+	return rewritten
+}
+
+// writeDeps writes deps into pkgDir, rewriting those in rewritten, or copies
+// them from cache. Up to jobs packages are written in parallel.
+func writeDeps(cache *rewriteCache, jobs int, pkgDir string, deps []*packages.Package, rewritten map[string]*bbinternal.Package, lines bbinternal.LineDirectives) error {
+	return forEach(jobs, len(deps), func(i int) error {
+		p := deps[i]
+		destination := filepath.Join(pkgDir, p.PkgPath)
+		if dep, ok := rewritten[p.ID]; ok {
+			dep.SetRewrittenDeps(rewritten)
+			options := append([]string{"dep", fmt.Sprint(lines), bbmainImportPath}, rewrittenImports(p, rewritten)...)
+			if err := cache.write(p, destination, options, func(dir string) error {
+				return dep.RewriteDep(dir, bbmainImportPath)
+			}); err != nil {
+				return fmt.Errorf("rewriting package %s failed: %v", p, err)
 			}
-			seenIDs[p.ID] = struct{}{}
+		} else if err := cache.copy(p, destination, []string{fmt.Sprint(lines)}, func(dir string) error {
+			return bbinternal.CopyPkg(p, dir, lines)
+		}); err != nil {
+			return fmt.Errorf("writing package %s failed: %v", p, err)
 		}
+		return nil
+	})
+}
+
+// forEach calls f with 0 through n-1 on up to jobs goroutines, or GOMAXPROCS
+// if jobs is not positive. It returns the errors of all calls that failed,
+// joined in order.
+func forEach(jobs, n int, f func(i int) error) error {
+	if jobs <= 0 {
+		jobs = runtime.GOMAXPROCS(0)
 	}
-	return nil
+	if jobs > n {
+		jobs = n
+	}
+	errs := make([]error, n)
+	next := make(chan int)
+	var wg sync.WaitGroup
+	for w := 0; w < jobs; w++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := range next {
+				errs[i] = f(i)
+			}
+		}()
+	}
+	for i := 0; i < n; i++ {
+		next <- i
+	}
+	close(next)
+	wg.Wait()
+	return errors.Join(errs...)
+}
+
+// rewrittenImports returns the paths of p's imports that are in rewritten, for
+// cache keys: rewritten packages call their init functions.
+func rewrittenImports(p *packages.Package, rewritten map[string]*bbinternal.Package) []string {
+	var paths []string
+	for path, imp := range p.Imports {
+		if _, ok := rewritten[imp.ID]; ok {
+			paths = append(paths, "rewritten "+path)
+		}
+	}
+	sort.Strings(paths)
+	return paths
 }
 
 // deps recursively iterates through imports and returns the set of packages
@@ -318,14 +1027,42 @@ func deps(p *packages.Package, filter func(p *packages.Package) bool) []*package
 	return pkgs
 }
 
-func collectDeps(p *packages.Package) []*packages.Package {
+func collectDeps(p *packages.Package, goroot string) []*packages.Package {
 	// If modules are not enabled, we need a copy of *ALL*
 	// non-standard-library dependencies in the temporary directory.
 	return deps(p, func(pkg *packages.Package) bool {
-		// First component of package path contains a "."?
-		//
-		// Poor man's standard library test.
-		firstComp := strings.SplitN(pkg.PkgPath, "/", 2)
-		return strings.Contains(firstComp[0], ".")
+		return !isStdlib(pkg, goroot)
 	})
 }
+
+// isStdlib returns true if p is a standard library package of the Go
+// installation in goroot.
+//
+// Import paths do not tell: module paths like example/tools or mytool and
+// GOPATH packages need no dot in their first element. Packages in modules are
+// not in the standard library, and other packages are if their files are in
+// GOROOT.
+func isStdlib(p *packages.Package, goroot string) bool {
+	if p.Module != nil {
+		return false
+	}
+	dir := packageDir(p)
+	if dir == "" {
+		// Without files, p cannot be built anyway. Copying it reports
+		// why.
+		return false
+	}
+	rel, err := filepath.Rel(filepath.Join(goroot, "src"), dir)
+	return err == nil && rel != ".." && !strings.HasPrefix(rel, ".."+string(filepath.Separator))
+}
+
+// packageDir returns the directory of p's files, or "" if p has none.
+func packageDir(p *packages.Package) string {
+	// CompiledGoFiles may be in the build cache.
+	for _, files := range [][]string{p.GoFiles, p.OtherFiles, p.IgnoredFiles} {
+		if len(files) > 0 {
+			return filepath.Dir(files[0])
+		}
+	}
+	return ""
+}
@@ -0,0 +1,1227 @@
+// Copyright 2024 the u-root Authors. All rights reserved
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package bb
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"log"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"reflect"
+	"regexp"
+	"runtime"
+	"strings"
+	"sync/atomic"
+	"testing"
+
+	"golang.org/x/tools/go/packages"
+
+	"github.com/u-root/gobusybox/src/pkg/golang"
+	"github.com/u-root/uio/ulog/ulogtest"
+)
+
+func TestBuildBusybox(t *testing.T) {
+	for _, tt := range []struct {
+		name string
+		// file paths to commands to compile
+		cmds []string
+		// extra options
+		opts func(o *Opts)
+		// command name -> expected output
+		want map[string]string
+		// If set, BuildBusybox is expected to fail with an error
+		// containing this.
+		wantErr string
+	}{
+		{
+			name: "tuple-vars",
+			cmds: []string{"./test/tuplevars"},
+			want: map[string]string{
+				"tuplevars": "1 true 42 <nil> false s 2 x y\n",
+			},
+		},
+		{
+			name: "unnameable-types",
+			cmds: []string{"./test/unnameable"},
+			want: map[string]string{
+				"unnameable": "1 11 21 pair 7 secret\n<nil> false value of k <nil>\n",
+			},
+		},
+		{
+			name: "line-directives",
+			cmds: []string{"./test/linedirectives"},
+			want: map[string]string{
+				"linedirectives": "main.go:18 main.go:21\n",
+			},
+		},
+		{
+			name: "intercept-exits",
+			cmds: []string{"./test/exits"},
+			opts: func(o *Opts) {
+				o.InterceptExits = true
+			},
+			want: map[string]string{
+				"exits": "ok\n",
+			},
+		},
+		{
+			name: "exec",
+			cmds: []string{"./test/exits", "./test/execer"},
+			opts: func(o *Opts) {
+				o.InterceptExits = true
+				o.InterceptStdio = true
+			},
+			want: map[string]string{
+				"execer": "0 \"ok\"\n1 \"exit 3\"\n2 \"flag provided but not defined: -nope\"\n" +
+					"1 \"exit 4\"\n1 \"exit 5\"\n0 \"ok\"\n" +
+					"exit 6\n1 <nil>\n",
+			},
+		},
+		{
+			name: "reset-vars",
+			cmds: []string{"./test/resetvars"},
+			want: map[string]string{
+				"resetvars": "embedded 1 true 2\n",
+			},
+		},
+		{
+			name: "rewrite-deps",
+			cmds: []string{"./test/deferdeps/usesdep", "./test/deferdeps/nodep"},
+			opts: func(o *Opts) {
+				o.RewriteDeps = true
+			},
+			want: map[string]string{
+				// dep is only initialized for usesdep.
+				"nodep":   "nodep\n",
+				"usesdep": "dep var initialized\ndep init initialized\nhello world\n",
+			},
+		},
+		{
+			name: "rewrite-deps-in-process",
+			cmds: []string{"./test/deferdeps/usesdep", "./test/deferdeps/depexecer", "./test/deferdeps/depsharer"},
+			opts: func(o *Opts) {
+				o.RewriteDeps = true
+				o.InterceptExits = true
+				o.InterceptStdio = true
+			},
+			want: map[string]string{
+				// dep is initialized again for each invocation,
+				// registering -name on its flag.CommandLine.
+				"depexecer": "dep var initialized\ndep init initialized\n0 \"hello gopher\\n\"\n" +
+					"dep var initialized\ndep init initialized\n0 \"hello world\\n\"\n",
+				// Nested runs do not initialize dep again for
+				// depsharer, which already uses it. -name, registered
+				// on the busybox's startup flag.CommandLine, is reset
+				// for usesdep and restored for depsharer.
+				"depsharer": "dep var initialized\ndep init initialized\n" +
+					"0 \"hello world\"\n0 \"hello gopher\"\n" +
+					"hello world\n",
+			},
+		},
+		{
+			name: "aliases",
+			cmds: []string{"./test/argv0"},
+			opts: func(o *Opts) {
+				o.Aliases = map[string]string{"zero": "argv0", "[": "argv0"}
+			},
+			want: map[string]string{
+				"argv0": "argv0\n",
+				"zero":  "zero\n",
+				"[":     "[\n",
+			},
+		},
+		{
+			name: "alias-unknown-command",
+			cmds: []string{"./test/argv0"},
+			opts: func(o *Opts) {
+				o.Aliases = map[string]string{"gunzip": "gzip"}
+			},
+			wantErr: "alias gunzip refers to unknown command gzip",
+		},
+		{
+			name: "alias-conflict",
+			cmds: []string{"./test/argv0", "./test/tuplevars"},
+			opts: func(o *Opts) {
+				o.Aliases = map[string]string{"tuplevars": "argv0"}
+			},
+			wantErr: "alias tuplevars for command argv0 conflicts with command tuplevars",
+		},
+		{
+			name: "major-version-suffix",
+			cmds: []string{"./test/argv0/v2"},
+			want: map[string]string{
+				"argv0": "argv0 v2\n",
+			},
+		},
+		{
+			name:    "duplicate-names",
+			cmds:    []string{"./test/argv0", "./test/argv0/v2"},
+			wantErr: "found duplicate command argv0",
+		},
+		{
+			name: "explicit-name",
+			cmds: []string{"./test/argv0", "other=./test/argv0/v2"},
+			want: map[string]string{
+				"argv0": "argv0\n",
+				"other": "other v2\n",
+			},
+		},
+		{
+			name: "explicit-name-opts",
+			cmds: []string{"./test/argv0"},
+			opts: func(o *Opts) {
+				o.CommandNames = map[string]string{"other": "./test/argv0/v2"}
+			},
+			want: map[string]string{
+				"argv0": "argv0\n",
+				"other": "other v2\n",
+			},
+		},
+		{
+			name:    "explicit-name-glob",
+			cmds:    []string{"x=./test/argv0/..."},
+			wantErr: "command name x must be given for exactly one package",
+		},
+		{
+			name: "module-mode",
+			cmds: []string{"./test/moduledeps", "./test/resetvars"},
+			opts: func(o *Opts) {
+				o.ModuleMode = true
+			},
+			want: map[string]string{
+				"moduledeps": "uio\n",
+				"resetvars":  "embedded 1 true 2\n",
+			},
+		},
+		{
+			name: "dotless-module-path",
+			cmds: []string{"./test/dotless"},
+			opts: func(o *Opts) {
+				// GOFLAGS are meant for this module, not
+				// for test/dotless.
+				o.Env.Apply(golang.WithWorkingDir("./test/dotless"), golang.WithoutModuleGOFLAGS())
+			},
+			want: map[string]string{
+				"mytool": "hello from corp/lib\n",
+			},
+		},
+		{
+			name: "dotless-module-path-module-mode",
+			cmds: []string{"./test/dotless"},
+			opts: func(o *Opts) {
+				o.Env.Apply(golang.WithWorkingDir("./test/dotless"), golang.WithoutModuleGOFLAGS())
+				o.ModuleMode = true
+			},
+			want: map[string]string{
+				"mytool": "hello from corp/lib\n",
+			},
+		},
+		{
+			// Without BuildInfo, commands get the busybox's.
+			name: "no-build-info",
+			cmds: []string{"./test/buildinfo"},
+			want: map[string]string{
+				"buildinfo": "bb.u-root.com/bb  \n",
+			},
+		},
+		{
+			name: "build-info",
+			cmds: []string{"./test/buildinfo"},
+			opts: func(o *Opts) {
+				o.BuildInfo = true
+			},
+			want: map[string]string{
+				"buildinfo": "github.com/u-root/gobusybox/src/pkg/bb/test/buildinfo github.com/u-root/gobusybox/src (devel)\ngithub.com/u-root/uio v0.0.0-20210528151154-e40b768296a7\n",
+			},
+		},
+		{
+			name:    "unnameable-types-error",
+			cmds:    []string{"./test/unnameableerr"},
+			wantErr: "cannot move initializer of global variable c into a function",
+		},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			dir := t.TempDir()
+			binary := filepath.Join(dir, "bb")
+			opts := &Opts{
+				Env:          golang.Default(golang.DisableCGO()),
+				GenSrcDir:    filepath.Join(dir, "gen"),
+				CommandPaths: tt.cmds,
+				BinaryPath:   binary,
+			}
+			if tt.opts != nil {
+				tt.opts(opts)
+			}
+			err := BuildBusybox(&ulogtest.Logger{TB: t}, opts)
+			if tt.wantErr != "" {
+				if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+					t.Fatalf("BuildBusybox = %v, want error containing %q", err, tt.wantErr)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("BuildBusybox = %v", err)
+			}
+
+			for cmdName, want := range tt.want {
+				out, err := exec.Command(binary, cmdName).CombinedOutput()
+				if err != nil {
+					t.Fatalf("%s %s: %v (output: %s)", binary, cmdName, err, out)
+				}
+				if got := string(out); got != want {
+					t.Errorf("Output of %s = %q, want %q", cmdName, got, want)
+				}
+			}
+		})
+	}
+}
+
+// TestStandalone tests that commands behave the same in a busybox as when
+// built on their own with the go command.
+func TestStandalone(t *testing.T) {
+	dir := t.TempDir()
+	binary := filepath.Join(dir, "bb")
+	opts := &Opts{
+		Env:          golang.Default(golang.DisableCGO()),
+		GenSrcDir:    filepath.Join(dir, "gen"),
+		CommandPaths: []string{"./test/loopvar", "./test/godebug"},
+		BinaryPath:   binary,
+	}
+	if err := BuildBusybox(&ulogtest.Logger{TB: t}, opts); err != nil {
+		t.Fatalf("BuildBusybox = %v", err)
+	}
+
+	for _, tt := range []struct {
+		name string
+		cmd  string
+		env  []string
+	}{
+		{
+			// The language version of the module.
+			name: "loopvar",
+			cmd:  "loopvar",
+		},
+		{
+			// Default GODEBUG settings from //go:debug.
+			name: "godebug",
+			cmd:  "godebug",
+		},
+		{
+			name: "godebug-user",
+			cmd:  "godebug",
+			env:  []string{"GODEBUG=panicnil=0"},
+		},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			run := exec.Command("go", "run", "./test/"+tt.cmd)
+			run.Env = append(os.Environ(), tt.env...)
+			want, err := run.CombinedOutput()
+			if err != nil {
+				t.Fatalf("go run: %v (output: %s)", err, want)
+			}
+
+			bb := exec.Command(binary, tt.cmd)
+			bb.Env = append(os.Environ(), tt.env...)
+			got, err := bb.CombinedOutput()
+			if err != nil {
+				t.Fatalf("%s %s: %v (output: %s)", binary, tt.cmd, err, got)
+			}
+			if string(got) != string(want) {
+				t.Errorf("Output of %s = %q, want %q as with go run", tt.cmd, got, want)
+			}
+		})
+	}
+}
+
+func TestInstall(t *testing.T) {
+	dir := t.TempDir()
+	binary := filepath.Join(dir, "bb")
+	opts := &Opts{
+		Env:          golang.Default(golang.DisableCGO()),
+		GenSrcDir:    filepath.Join(dir, "gen"),
+		CommandPaths: []string{"./test/tuplevars", "./test/linedirectives"},
+		BinaryPath:   binary,
+	}
+	if err := BuildBusybox(&ulogtest.Logger{TB: t}, opts); err != nil {
+		t.Fatalf("BuildBusybox = %v", err)
+	}
+
+	for _, tt := range []struct {
+		name string
+		args []string
+		// existing file to create in the install directory first
+		existing string
+		// want is the expected link target for each command; for
+		// shellbang files, their contents.
+		want    func(dir string) map[string]string
+		wantErr bool
+	}{
+		{
+			name: "relative-symlink",
+			want: func(string) map[string]string {
+				return map[string]string{"tuplevars": "../bb", "linedirectives": "../bb"}
+			},
+		},
+		{
+			name: "absolute-symlink",
+			args: []string{"-absolute"},
+			want: func(string) map[string]string {
+				return map[string]string{"tuplevars": binary, "linedirectives": binary}
+			},
+		},
+		{
+			name: "hard",
+			args: []string{"-link=hard"},
+		},
+		{
+			// Hard links in a staged image are made to the
+			// busybox on the host.
+			name: "hard-target",
+			args: []string{"-link=hard", "-target=" + binary},
+		},
+		{
+			name:    "hard-target-missing",
+			args:    []string{"-link=hard", "-target=" + filepath.Join(dir, "bbin", "bb")},
+			wantErr: true,
+		},
+		{
+			name: "shellbang",
+			args: []string{"-link=shellbang"},
+			want: func(dir string) map[string]string {
+				return map[string]string{
+					"tuplevars":      "#!" + binary + " #!" + filepath.Join(dir, "tuplevars") + "\n",
+					"linedirectives": "#!" + binary + " #!" + filepath.Join(dir, "linedirectives") + "\n",
+				}
+			},
+		},
+		{
+			// Shellbang files in a staged image name the
+			// command next to the busybox in the image.
+			name: "shellbang-target",
+			args: []string{"-link=shellbang", "-target=/bbin/bb"},
+			want: func(string) map[string]string {
+				return map[string]string{
+					"tuplevars":      "#!/bbin/bb #!/bbin/tuplevars\n",
+					"linedirectives": "#!/bbin/bb #!/bbin/linedirectives\n",
+				}
+			},
+		},
+		{
+			// Links in a staged image point at the busybox's
+			// path in the image, not on the host.
+			name: "staging",
+			args: []string{"-target=/bbin/bb"},
+			want: func(string) map[string]string {
+				return map[string]string{"tuplevars": "/bbin/bb", "linedirectives": "/bbin/bb"}
+			},
+		},
+		{
+			name: "staging-relative",
+			args: []string{"-target=../bbin/bb"},
+			want: func(string) map[string]string {
+				return map[string]string{"tuplevars": "../bbin/bb", "linedirectives": "../bbin/bb"}
+			},
+		},
+		{
+			name:     "exists",
+			existing: "tuplevars",
+			wantErr:  true,
+		},
+		{
+			name:     "exists-skip",
+			args:     []string{"-overwrite=skip"},
+			existing: "tuplevars",
+			want: func(string) map[string]string {
+				return map[string]string{"tuplevars": "existing", "linedirectives": "../bb"}
+			},
+		},
+		{
+			name:     "exists-replace",
+			args:     []string{"-overwrite=replace"},
+			existing: "tuplevars",
+			want: func(string) map[string]string {
+				return map[string]string{"tuplevars": "../bb", "linedirectives": "../bb"}
+			},
+		},
+		{
+			name:    "bad-link",
+			args:    []string{"-link=soft"},
+			wantErr: true,
+		},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			installDir := filepath.Join(dir, tt.name)
+			if tt.existing != "" {
+				if err := os.MkdirAll(installDir, 0o755); err != nil {
+					t.Fatal(err)
+				}
+				if err := os.WriteFile(filepath.Join(installDir, tt.existing), []byte("existing"), 0o644); err != nil {
+					t.Fatal(err)
+				}
+			}
+
+			args := append(append([]string{"--install"}, tt.args...), installDir)
+			out, err := exec.Command(binary, args...).CombinedOutput()
+			if tt.wantErr {
+				if err == nil {
+					t.Fatalf("%s %v succeeded, want error", binary, args)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("%s %v: %v (output: %s)", binary, args, err, out)
+			}
+
+			if tt.want == nil {
+				// Installed commands must run.
+				out, err := exec.Command(filepath.Join(installDir, "tuplevars")).CombinedOutput()
+				if err != nil || string(out) != "1 true 42 <nil> false s 2 x y\n" {
+					t.Errorf("Installed tuplevars = (%q, %v), want tuplevars output", out, err)
+				}
+				return
+			}
+			for name, want := range tt.want(installDir) {
+				path := filepath.Join(installDir, name)
+				got, err := os.Readlink(path)
+				if err != nil {
+					b, rerr := os.ReadFile(path)
+					if rerr != nil {
+						t.Fatal(rerr)
+					}
+					got = string(b)
+				}
+				if got != want {
+					t.Errorf("%s = %q, want %q", name, got, want)
+				}
+			}
+		})
+	}
+}
+
+func TestManifest(t *testing.T) {
+	dir := t.TempDir()
+	manifestPath := filepath.Join(dir, "manifest.json")
+	opts := &Opts{
+		Env:           golang.Default(golang.DisableCGO()),
+		GenSrcDir:     filepath.Join(dir, "gen"),
+		CommandPaths:  []string{"./test/moduledeps", "./test/resetvars"},
+		Aliases:       map[string]string{"md": "moduledeps"},
+		GenerateOnly:  true,
+		ManifestPath:  manifestPath,
+		SPDXPath:      filepath.Join(dir, "bb.spdx.json"),
+		CycloneDXPath: filepath.Join(dir, "bb.cdx.json"),
+	}
+	t.Setenv("SOURCE_DATE_EPOCH", "1700000000")
+	if err := BuildBusybox(&ulogtest.Logger{TB: t}, opts); err != nil {
+		t.Fatalf("BuildBusybox = %v", err)
+	}
+
+	data, err := os.ReadFile(manifestPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var m Manifest
+	if err := json.Unmarshal(data, &m); err != nil {
+		t.Fatalf("manifest is not valid JSON: %v", err)
+	}
+
+	wantCmds := []ManifestCommand{
+		{
+			Name:    "moduledeps",
+			Aliases: []string{"md"},
+			PkgPath: "github.com/u-root/gobusybox/src/pkg/bb/test/moduledeps",
+			Module:  "github.com/u-root/gobusybox/src",
+		},
+		{
+			Name:    "resetvars",
+			PkgPath: "github.com/u-root/gobusybox/src/pkg/bb/test/resetvars",
+			Module:  "github.com/u-root/gobusybox/src",
+		},
+	}
+	if !reflect.DeepEqual(m.Commands, wantCmds) {
+		t.Errorf("Commands = %+v, want %+v", m.Commands, wantCmds)
+	}
+	if m.GoVersion == "" || m.GOOS == "" || m.GOARCH == "" {
+		t.Errorf("manifest is missing the Go version or platform: %+v", m)
+	}
+
+	var hasPkg bool
+	for _, p := range m.Packages {
+		if p.PkgPath == "github.com/u-root/uio/uio" {
+			hasPkg = p.Module == "github.com/u-root/uio"
+		}
+	}
+	if !hasPkg {
+		t.Errorf("Packages = %+v, want github.com/u-root/uio/uio in module github.com/u-root/uio", m.Packages)
+	}
+
+	mods := make(map[string]ManifestModule)
+	for _, mod := range m.Modules {
+		mods[mod.Path] = mod
+	}
+	if mod := mods["github.com/u-root/gobusybox/src"]; mod.Version != "" || mod.Sum != "" {
+		t.Errorf("main module = %+v, want no version or sum", mod)
+	}
+	if mod := mods["github.com/u-root/uio"]; mod.Version != "v0.0.0-20210528151154-e40b768296a7" || !strings.HasPrefix(mod.Sum, "h1:") || mod.License != "BSD-3-Clause" {
+		t.Errorf("uio module = %+v, want version v0.0.0-20210528151154-e40b768296a7 with a checksum and license BSD-3-Clause", mod)
+	}
+
+	var spdx struct {
+		SPDXVersion       string
+		DocumentNamespace string
+		CreationInfo      struct {
+			Created string
+		}
+		Packages []struct {
+			Name            string
+			VersionInfo     string
+			LicenseDeclared string
+			ExternalRefs    []struct {
+				ReferenceType    string
+				ReferenceLocator string
+			}
+		}
+	}
+	readJSON(t, opts.SPDXPath, &spdx)
+	if spdx.SPDXVersion != "SPDX-2.3" || spdx.CreationInfo.Created != "2023-11-14T22:13:20Z" || !strings.HasPrefix(spdx.DocumentNamespace, "urn:uuid:") {
+		t.Errorf("SPDX document = %+v, want SPDX-2.3 created at SOURCE_DATE_EPOCH with a urn:uuid: namespace", spdx)
+	}
+	spdxPkgs := make(map[string]string)
+	for _, p := range spdx.Packages {
+		var sum string
+		for _, ref := range p.ExternalRefs {
+			if ref.ReferenceType == "gosum" {
+				sum = ref.ReferenceLocator
+			}
+		}
+		spdxPkgs[p.Name] = strings.Join([]string{p.VersionInfo, p.LicenseDeclared, sum}, " ")
+	}
+	wantSPDX := map[string]string{
+		"bb":                              " NOASSERTION ",
+		"moduledeps":                      " NOASSERTION ",
+		"resetvars":                       " NOASSERTION ",
+		"github.com/u-root/gobusybox/src": " NOASSERTION ",
+		"github.com/u-root/uio":           "v0.0.0-20210528151154-e40b768296a7 BSD-3-Clause " + mods["github.com/u-root/uio"].Sum,
+	}
+	if !reflect.DeepEqual(spdxPkgs, wantSPDX) {
+		t.Errorf("SPDX packages = %v, want %v", spdxPkgs, wantSPDX)
+	}
+
+	var cdx struct {
+		BOMFormat string
+		Metadata  struct {
+			Component struct {
+				Name       string
+				Components []struct {
+					Name string
+				}
+			}
+		}
+		Components []struct {
+			PURL       string
+			Properties []struct {
+				Name  string
+				Value string
+			}
+		}
+	}
+	readJSON(t, opts.CycloneDXPath, &cdx)
+	if cdx.BOMFormat != "CycloneDX" || cdx.Metadata.Component.Name != "bb" || len(cdx.Metadata.Component.Components) != 2 {
+		t.Errorf("CycloneDX BOM = %+v, want bb component with 2 commands", cdx)
+	}
+	var purls, sums []string
+	for _, c := range cdx.Components {
+		purls = append(purls, c.PURL)
+		for _, p := range c.Properties {
+			if p.Name == "gobusybox:gosum" {
+				sums = append(sums, p.Value)
+			}
+		}
+	}
+	if want := []string{"", "pkg:golang/github.com/u-root/uio@v0.0.0-20210528151154-e40b768296a7"}; !reflect.DeepEqual(purls, want) {
+		t.Errorf("CycloneDX purls = %v, want %v", purls, want)
+	}
+	if want := []string{mods["github.com/u-root/uio"].Sum}; !reflect.DeepEqual(sums, want) {
+		t.Errorf("CycloneDX go.sum properties = %v, want %v", sums, want)
+	}
+}
+
+func readJSON(t *testing.T, path string, v any) {
+	t.Helper()
+	data, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := json.Unmarshal(data, v); err != nil {
+		t.Fatalf("%s is not valid JSON: %v", path, err)
+	}
+}
+
+func TestLicenses(t *testing.T) {
+	dir := t.TempDir()
+	binary := filepath.Join(dir, "bb")
+	opts := &Opts{
+		Env:           golang.Default(golang.DisableCGO()),
+		GenSrcDir:     filepath.Join(dir, "gen"),
+		CommandPaths:  []string{"./test/moduledeps"},
+		BinaryPath:    binary,
+		NoticePath:    filepath.Join(dir, "NOTICE"),
+		EmbedLicenses: true,
+	}
+	if err := BuildBusybox(&ulogtest.Logger{TB: t}, opts); err != nil {
+		t.Fatalf("BuildBusybox = %v", err)
+	}
+
+	notice, err := os.ReadFile(opts.NoticePath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	goroot, err := opts.Env.GoRoot()
+	if err != nil {
+		t.Fatal(err)
+	}
+	goLicense, err := os.ReadFile(filepath.Join(goroot, "LICENSE"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, want := range []string{
+		// The Go distribution's license comes first.
+		"0 directories in GOPATH.\n\n" + noticeSeparator + "\nGo go",
+		"\nLicense: BSD-3-Clause\n" + noticeSeparator + "\n\n--- LICENSE ---\n\n" + string(bytes.TrimSpace(goLicense)) + "\n",
+		"github.com/u-root/gobusybox/src\nLicense: unknown\n",
+		"github.com/u-root/uio v0.0.0-20210528151154-e40b768296a7\nLicense: BSD-3-Clause\n",
+		"--- LICENSE ---\n\nBSD 3-Clause License\n",
+	} {
+		if !strings.Contains(string(notice), want) {
+			t.Errorf("notice does not contain %q:\n%s", want, notice)
+		}
+	}
+
+	out, err := exec.Command(binary, "--licenses").Output()
+	if err != nil {
+		t.Fatalf("bb --licenses: %v", err)
+	}
+	if string(out) != string(notice) {
+		t.Errorf("bb --licenses = %s, want the notice file", out)
+	}
+
+	t.Run("gopath", func(t *testing.T) {
+		// GOPATH packages take their license files from their
+		// directory or a parent, or have none.
+		gopath := t.TempDir()
+		for name, src := range map[string]string{
+			"legacy/lib/LICENSE":        "Permission is hereby granted, free of charge, to any person obtaining a copy",
+			"legacy/lib/greet/greet.go": "package greet\n\nfunc Hello() string { return \"hello from GOPATH\" }\n",
+			"legacy/hello/main.go":      "package main\n\nimport (\n\t\"fmt\"\n\n\t\"legacy/lib/greet\"\n)\n\nfunc main() { fmt.Println(greet.Hello()) }\n",
+		} {
+			path := filepath.Join(gopath, "src", name)
+			if err := os.MkdirAll(filepath.Dir(path), 0o755); err != nil {
+				t.Fatal(err)
+			}
+			if err := os.WriteFile(path, []byte(src), 0o644); err != nil {
+				t.Fatal(err)
+			}
+		}
+		env := golang.Default(golang.DisableCGO())
+		env.Apply(golang.WithGOPATH(env.GOPATH + string(filepath.ListSeparator) + gopath))
+		opts := &Opts{
+			Env:          env,
+			GenSrcDir:    filepath.Join(dir, "gen-gopath"),
+			CommandPaths: []string{filepath.Join(gopath, "src/legacy/hello")},
+			GenerateOnly: true,
+			NoticePath:   filepath.Join(dir, "NOTICE-gopath"),
+		}
+		if err := BuildBusybox(&ulogtest.Logger{TB: t}, opts); err != nil {
+			t.Fatalf("BuildBusybox = %v", err)
+		}
+		notice, err := os.ReadFile(opts.NoticePath)
+		if err != nil {
+			t.Fatal(err)
+		}
+		for _, want := range []string{
+			"the following 0 Go modules and 2 directories in GOPATH.\n",
+			"legacy/hello (GOPATH)\nLicense: unknown\n" + noticeSeparator + "\n\nNo license or notice files found.\n",
+			"legacy/lib (GOPATH)\nLicense: MIT\n" + noticeSeparator + "\n\n--- LICENSE ---\n\nPermission is hereby granted",
+		} {
+			if !strings.Contains(string(notice), want) {
+				t.Errorf("notice does not contain %q:\n%s", want, notice)
+			}
+		}
+	})
+}
+
+func TestIncremental(t *testing.T) {
+	dir := t.TempDir()
+	binary := filepath.Join(dir, "bb")
+	cacheDir := filepath.Join(dir, "cache")
+	build := func(t *testing.T) string {
+		var out bytes.Buffer
+		opts := &Opts{
+			Env:            golang.Default(golang.DisableCGO()),
+			GenSrcDir:      filepath.Join(dir, "gen"),
+			ReuseGenSrcDir: true,
+			CacheDir:       cacheDir,
+			CommandPaths:   []string{"./test/moduledeps", "./test/resetvars"},
+			BinaryPath:     binary,
+			GoBuildOpts:    &golang.BuildOpts{UseBuildCache: true},
+		}
+		if err := BuildBusybox(log.New(&out, "", 0), opts); err != nil {
+			t.Fatalf("BuildBusybox = %v\n%s", err, out.String())
+		}
+		got, err := exec.Command(binary, "moduledeps").CombinedOutput()
+		if err != nil || string(got) != "uio\n" {
+			t.Errorf("moduledeps = %q, %v, want uio", got, err)
+		}
+		return out.String()
+	}
+
+	// moduledeps, resetvars and the uio packages.
+	if out := build(t); !strings.Contains(out, "Reused 0 of 4 packages") {
+		t.Errorf("first build: want no packages from the cache, got log:\n%s", out)
+	}
+	if out := build(t); !strings.Contains(out, "Reused 4 of 4 packages") {
+		t.Errorf("second build: want all packages from the cache, got log:\n%s", out)
+	}
+
+	// Only previously generated directories are reused.
+	if err := os.WriteFile(filepath.Join(dir, "gen", "other"), nil, 0o644); err != nil {
+		t.Fatal(err)
+	}
+	opts := &Opts{
+		Env:            golang.Default(golang.DisableCGO()),
+		GenSrcDir:      filepath.Join(dir, "gen"),
+		ReuseGenSrcDir: true,
+		CommandPaths:   []string{"./test/moduledeps"},
+		BinaryPath:     binary,
+	}
+	if err := BuildBusybox(&ulogtest.Logger{TB: t}, opts); err == nil || !strings.Contains(err.Error(), "not a previously generated directory") {
+		t.Errorf("BuildBusybox = %v, want error about the generated directory", err)
+	}
+}
+
+// TestMixedGOPATH tests busyboxes of commands in modules and in GOPATH.
+func TestMixedGOPATH(t *testing.T) {
+	gopath := t.TempDir()
+	for name, src := range map[string]string{
+		"legacy/greet/greet.go":            "package greet\n\nfunc Hello() string { return \"hello from GOPATH\" }\n",
+		"legacy/hello/main.go":             "package main\n\nimport (\n\t\"fmt\"\n\n\t\"legacy/greet\"\n)\n\nfunc main() { fmt.Println(greet.Hello()) }\n",
+		"github.com/u-root/uio/uio/uio.go": "package uio\n\nfunc Old() string { return \"old uio\" }\n",
+		"legacy/olduio/main.go":            "package main\n\nimport (\n\t\"fmt\"\n\n\t\"github.com/u-root/uio/uio\"\n)\n\nfunc main() { fmt.Println(uio.Old()) }\n",
+	} {
+		path := filepath.Join(gopath, "src", name)
+		if err := os.MkdirAll(filepath.Dir(path), 0o755); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(path, []byte(src), 0o644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	for _, tt := range []struct {
+		name    string
+		cmds    []string
+		want    map[string]string
+		wantErr string
+	}{
+		{
+			name: "mixed",
+			cmds: []string{"./test/moduledeps", filepath.Join(gopath, "src/legacy/hello")},
+			want: map[string]string{
+				"moduledeps": "uio\n",
+				"hello":      "hello from GOPATH\n",
+			},
+		},
+		{
+			name:    "conflict",
+			cmds:    []string{"./test/moduledeps", filepath.Join(gopath, "src/legacy/olduio")},
+			wantErr: fmt.Sprintf("package github.com/u-root/uio/uio is in GOPATH (%s)", filepath.Join(gopath, "src/github.com/u-root/uio/uio")),
+		},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			dir := t.TempDir()
+			binary := filepath.Join(dir, "bb")
+			// The first GOPATH entry has the module cache.
+			env := golang.Default(golang.DisableCGO())
+			env.Apply(golang.WithGOPATH(env.GOPATH + string(filepath.ListSeparator) + gopath))
+			opts := &Opts{
+				Env:          env,
+				GenSrcDir:    filepath.Join(dir, "gen"),
+				CommandPaths: tt.cmds,
+				BinaryPath:   binary,
+			}
+			err := BuildBusybox(&ulogtest.Logger{TB: t}, opts)
+			if tt.wantErr != "" {
+				if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+					t.Fatalf("BuildBusybox = %v, want error containing %q", err, tt.wantErr)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("BuildBusybox = %v", err)
+			}
+			for cmdName, want := range tt.want {
+				out, err := exec.Command(binary, cmdName).CombinedOutput()
+				if err != nil {
+					t.Fatalf("%s %s: %v (output: %s)", binary, cmdName, err, out)
+				}
+				if got := string(out); got != want {
+					t.Errorf("Output of %s = %q, want %q", cmdName, got, want)
+				}
+			}
+		})
+	}
+}
+
+func TestGroups(t *testing.T) {
+	dir := t.TempDir()
+	small := filepath.Join(dir, "bb-small")
+	large := filepath.Join(dir, "bb-large")
+	opts := &Opts{
+		Env:       golang.Default(golang.DisableCGO()),
+		GenSrcDir: filepath.Join(dir, "gen"),
+		Groups: []Group{
+			{Name: "small", CommandPaths: []string{"./test/argv0"}, BinaryPath: small},
+			{Name: "large", CommandPaths: []string{"./test/argv0", "./test/resetvars"}, BinaryPath: large},
+		},
+		Aliases:      map[string]string{"zero": "argv0"},
+		ManifestPath: filepath.Join(dir, "manifest.json"),
+	}
+	if err := BuildBusybox(&ulogtest.Logger{TB: t}, opts); err != nil {
+		t.Fatalf("BuildBusybox = %v", err)
+	}
+
+	for _, tt := range []struct {
+		binary string
+		cmds   map[string]string
+		absent []string
+	}{
+		{
+			binary: small,
+			cmds:   map[string]string{"argv0": "argv0\n", "zero": "zero\n"},
+			absent: []string{"resetvars"},
+		},
+		{
+			binary: large,
+			cmds:   map[string]string{"argv0": "argv0\n", "zero": "zero\n", "resetvars": "embedded 1 true 2\n"},
+		},
+	} {
+		for cmdName, want := range tt.cmds {
+			out, err := exec.Command(tt.binary, cmdName).CombinedOutput()
+			if err != nil {
+				t.Fatalf("%s %s: %v (output: %s)", tt.binary, cmdName, err, out)
+			}
+			if got := string(out); got != want {
+				t.Errorf("Output of %s %s = %q, want %q", tt.binary, cmdName, got, want)
+			}
+		}
+		for _, cmdName := range tt.absent {
+			if out, err := exec.Command(tt.binary, cmdName).CombinedOutput(); err == nil {
+				t.Errorf("%s %s succeeded (output: %s), want command to be absent", tt.binary, cmdName, out)
+			}
+		}
+	}
+
+	for name, want := range map[string][]string{"manifest-small.json": {"argv0"}, "manifest-large.json": {"argv0", "resetvars"}} {
+		data, err := os.ReadFile(filepath.Join(dir, name))
+		if err != nil {
+			t.Fatal(err)
+		}
+		var m Manifest
+		if err := json.Unmarshal(data, &m); err != nil {
+			t.Fatalf("%s is not valid JSON: %v", name, err)
+		}
+		var got []string
+		for _, cmd := range m.Commands {
+			got = append(got, cmd.Name)
+		}
+		if !reflect.DeepEqual(got, want) {
+			t.Errorf("%s commands = %v, want %v", name, got, want)
+		}
+	}
+
+	for _, tt := range []struct {
+		name    string
+		opts    Opts
+		wantErr string
+	}{
+		{
+			name:    "binary-path",
+			opts:    Opts{Groups: []Group{{Name: "a", CommandPaths: []string{"./test/argv0"}}}, BinaryPath: "bb"},
+			wantErr: "command groups cannot be combined with",
+		},
+		{
+			name:    "invalid-name",
+			opts:    Opts{Groups: []Group{{Name: "a/b", CommandPaths: []string{"./test/argv0"}}}},
+			wantErr: `invalid command group name "a/b"`,
+		},
+		{
+			name: "duplicate-name",
+			opts: Opts{Groups: []Group{
+				{Name: "a", CommandPaths: []string{"./test/argv0"}},
+				{Name: "a", CommandPaths: []string{"./test/resetvars"}},
+			}},
+			wantErr: "duplicate command group a",
+		},
+		{
+			name: "conflicting-command-names",
+			opts: Opts{Groups: []Group{
+				{Name: "a", CommandPaths: []string{"./test/argv0"}},
+				{Name: "b", CommandPaths: []string{"zero=./test/argv0"}},
+			}},
+			wantErr: "is named both argv0 and zero",
+		},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			opts := tt.opts
+			opts.Env = golang.Default(golang.DisableCGO())
+			opts.GenSrcDir = t.TempDir()
+			opts.GenerateOnly = true
+			if err := BuildBusybox(&ulogtest.Logger{TB: t}, &opts); err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+				t.Errorf("BuildBusybox = %v, want error containing %q", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestTargets(t *testing.T) {
+	dir := t.TempDir()
+	host := Target{GOOS: runtime.GOOS, GOARCH: runtime.GOARCH}
+	other := Target{GOOS: "linux", GOARCH: "riscv64"}
+	if host == other {
+		other.GOARCH = "amd64"
+	}
+	var out bytes.Buffer
+	opts := &Opts{
+		Env:          golang.Default(golang.DisableCGO()),
+		GenSrcDir:    filepath.Join(dir, "gen"),
+		CommandPaths: []string{"./test/argv0", "./test/moduledeps"},
+		BinaryPath:   filepath.Join(dir, "bb-{{.GOOS}}-{{.GOARCH}}"),
+		ManifestPath: filepath.Join(dir, "{{.GOARCH}}.json"),
+		Targets:      []Target{host, other},
+	}
+	if err := BuildBusybox(log.New(&out, "", 0), opts); err != nil {
+		t.Fatalf("BuildBusybox = %v\n%s", err, out.String())
+	}
+
+	for _, target := range opts.Targets {
+		for _, path := range []string{
+			filepath.Join(dir, fmt.Sprintf("bb-%s-%s", target.GOOS, target.GOARCH)),
+			filepath.Join(dir, target.GOARCH+".json"),
+			filepath.Join(dir, "gen", target.GOOS+"_"+target.GOARCH, "src/bb.u-root.com/bb/main.go"),
+		} {
+			if _, err := os.Stat(path); err != nil {
+				t.Errorf("%s was not written: %v", target, err)
+			}
+		}
+	}
+	got, err := exec.Command(filepath.Join(dir, fmt.Sprintf("bb-%s-%s", host.GOOS, host.GOARCH)), "argv0").CombinedOutput()
+	if err != nil || string(got) != "argv0\n" {
+		t.Errorf("argv0 = %q, %v, want argv0", got, err)
+	}
+	// The copied packages of github.com/u-root/uio, whose files are the
+	// same on both targets, are reused. The commands are rewritten for
+	// each target, the same way, so their files are shared.
+	if !strings.Contains(out.String(), "Reused 0 of 4 packages") || !strings.Contains(out.String(), "Reused 2 of 4 packages from cache") ||
+		!strings.Contains(out.String(), "2 others were written the same as cached ones") {
+		t.Errorf("want the second target to reuse the first target's copied packages and share its rewritten ones, got log:\n%s", out.String())
+	}
+
+	// Sharing must not change what is generated for a target.
+	alone := &Opts{
+		Env:          golang.Default(golang.DisableCGO()),
+		GenSrcDir:    filepath.Join(dir, "alone"),
+		CommandPaths: opts.CommandPaths,
+		Targets:      []Target{other},
+		GenerateOnly: true,
+	}
+	if err := BuildBusybox(&ulogtest.Logger{TB: t}, alone); err != nil {
+		t.Fatalf("BuildBusybox = %v", err)
+	}
+	targetDir := other.GOOS + "_" + other.GOARCH
+	if diff := diffTrees(t, filepath.Join(alone.GenSrcDir, targetDir), filepath.Join(opts.GenSrcDir, targetDir)); diff != "" {
+		t.Errorf("%s generated with a shared cache differs from generated alone: %s", other, diff)
+	}
+
+	for _, tt := range []struct {
+		name    string
+		opts    Opts
+		wantErr string
+	}{
+		{
+			name:    "same-output",
+			opts:    Opts{BinaryPath: "bb-{{.GOOS}}", Targets: []Target{{"linux", "amd64"}, {"linux", "arm64"}}},
+			wantErr: "targets linux/amd64 and linux/arm64 would both be written to bb-linux",
+		},
+		{
+			name:    "duplicate",
+			opts:    Opts{BinaryPath: "bb-{{.GOARCH}}", Targets: []Target{{"linux", "amd64"}, {"linux", "amd64"}}},
+			wantErr: "duplicate target linux/amd64",
+		},
+		{
+			name:    "invalid-template",
+			opts:    Opts{BinaryPath: "bb-{{.GOARM}}", Targets: []Target{{"linux", "arm"}}},
+			wantErr: `invalid output path template "bb-{{.GOARM}}"`,
+		},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			opts := tt.opts
+			opts.Env = golang.Default(golang.DisableCGO())
+			opts.CommandPaths = []string{"./test/argv0"}
+			if err := BuildBusybox(&ulogtest.Logger{TB: t}, &opts); err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+				t.Errorf("BuildBusybox = %v, want error containing %q", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+// diffTrees returns a description of the first difference between the files
+// in directories a and b, or "" if they have the same files with the same
+// contents.
+func diffTrees(t *testing.T, a, b string) string {
+	t.Helper()
+	files := func(root string) map[string]string {
+		m := make(map[string]string)
+		if err := filepath.Walk(root, func(path string, info os.FileInfo, err error) error {
+			if err != nil || info.IsDir() {
+				return err
+			}
+			data, err := os.ReadFile(path)
+			if err != nil {
+				return err
+			}
+			rel, err := filepath.Rel(root, path)
+			m[rel] = string(data)
+			return err
+		}); err != nil {
+			t.Fatal(err)
+		}
+		return m
+	}
+	fa, fb := files(a), files(b)
+	for name, data := range fa {
+		if other, ok := fb[name]; !ok {
+			return name + " is missing"
+		} else if other != data {
+			return name + " has other contents"
+		}
+	}
+	for name := range fb {
+		if _, ok := fa[name]; !ok {
+			return name + " is extra"
+		}
+	}
+	return ""
+}
+
+func TestIsStdlib(t *testing.T) {
+	goroot := filepath.Join(t.TempDir(), "go")
+	gopath := filepath.Join(t.TempDir(), "gopath")
+	for _, tt := range []struct {
+		name string
+		p    *packages.Package
+		want bool
+	}{
+		{
+			name: "stdlib",
+			p:    &packages.Package{PkgPath: "fmt", GoFiles: []string{filepath.Join(goroot, "src/fmt/print.go")}},
+			want: true,
+		},
+		{
+			name: "vendored-stdlib",
+			p:    &packages.Package{PkgPath: "vendor/golang.org/x/net/dns/dnsmessage", GoFiles: []string{filepath.Join(goroot, "src/vendor/golang.org/x/net/dns/dnsmessage/message.go")}},
+			want: true,
+		},
+		{
+			name: "dotless-module",
+			p: &packages.Package{
+				PkgPath: "corp/lib/greet",
+				GoFiles: []string{filepath.Join(gopath, "pkg/mod/corp/lib/greet/greet.go")},
+				Module:  &packages.Module{Path: "corp/lib"},
+			},
+		},
+		{
+			name: "dotless-gopath",
+			p:    &packages.Package{PkgPath: "mytool", GoFiles: []string{filepath.Join(gopath, "src/mytool/main.go")}},
+		},
+		{
+			name: "next-to-goroot",
+			p:    &packages.Package{PkgPath: "mytool", GoFiles: []string{filepath.Join(goroot, "srcx/mytool/main.go")}},
+		},
+		{
+			name: "no-files",
+			p:    &packages.Package{PkgPath: "mytool"},
+		},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := isStdlib(tt.p, goroot); got != tt.want {
+				t.Errorf("isStdlib = %t, want %t", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestForEach(t *testing.T) {
+	const jobs = 3
+	var running, maxRunning atomic.Int32
+	err := forEach(jobs, 20, func(i int) error {
+		n := running.Add(1)
+		defer running.Add(-1)
+		for {
+			m := maxRunning.Load()
+			if n <= m || maxRunning.CompareAndSwap(m, n) {
+				break
+			}
+		}
+		if i%7 == 3 {
+			return fmt.Errorf("job %d failed", i)
+		}
+		return nil
+	})
+	if got := maxRunning.Load(); got > jobs {
+		t.Errorf("%d jobs ran at once, want at most %d", got, jobs)
+	}
+	// All errors, in order.
+	want := "job 3 failed\njob 10 failed\njob 17 failed"
+	if err == nil || err.Error() != want {
+		t.Errorf("forEach = %v, want %q", err, want)
+	}
+}
+
+func TestCopyDeps(t *testing.T) {
+	dir := t.TempDir()
+	opts := &Opts{
+		Env:          golang.Default(golang.DisableCGO()),
+		GenSrcDir:    filepath.Join(dir, "gen"),
+		CommandPaths: []string{"./test/moduledeps"},
+		GenerateOnly: true,
+	}
+	if err := BuildBusybox(&ulogtest.Logger{TB: t}, opts); err != nil {
+		t.Fatalf("BuildBusybox = %v", err)
+	}
+
+	pkgs, err := opts.Env.Lookup(packages.NeedName|packages.NeedFiles, "github.com/u-root/uio/uio")
+	if err != nil || len(pkgs) != 1 {
+		t.Fatalf("Lookup = %v, %v", pkgs, err)
+	}
+	// Dependencies are copied verbatim, except for the language version
+	// constraint and the //line directive keeping lines in place.
+	added := regexp.MustCompile(`(?m)^(//go:build go1\.\d+\n\n|//line \w+\.go:\d+\n)`)
+	for _, f := range pkgs[0].GoFiles {
+		want, err := os.ReadFile(f)
+		if err != nil {
+			t.Fatal(err)
+		}
+		got, err := os.ReadFile(filepath.Join(opts.GenSrcDir, "src/github.com/u-root/uio/uio", filepath.Base(f)))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got := added.ReplaceAll(got, nil); !bytes.Equal(got, want) {
+			t.Errorf("%s was not copied verbatim:\n%s", filepath.Base(f), got)
+		}
+	}
+}
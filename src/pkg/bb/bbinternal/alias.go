@@ -0,0 +1,14 @@
+// Copyright 2024 the u-root Authors. All rights reserved
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+//go:build go1.22
+
+package bbinternal
+
+import "go/types"
+
+// unalias returns the type t denotes if it is an alias such as any.
+func unalias(t types.Type) types.Type {
+	return types.Unalias(t)
+}
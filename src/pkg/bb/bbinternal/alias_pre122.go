@@ -0,0 +1,14 @@
+// Copyright 2024 the u-root Authors. All rights reserved
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+//go:build !go1.22
+
+package bbinternal
+
+import "go/types"
+
+// unalias returns t: before Go 1.22, go/types does not represent aliases.
+func unalias(t types.Type) types.Type {
+	return t
+}
@@ -15,6 +15,7 @@ import (
 	"go/ast"
 	"go/format"
 	"go/parser"
+	"go/printer"
 	"go/token"
 	"go/types"
 	"io/ioutil"
@@ -87,7 +88,7 @@ func CreateBBMainSource(fset *token.FileSet, files []*ast.File, pkgs []string, d
 	for _, pkg := range pkgs {
 		astutil.AddNamedImport(fset, files[0], "_", pkg)
 	}
-	return writeFiles(destDir, fset, files)
+	return writeFiles(destDir, fset, files, LineDirectivesNone, "")
 }
 
 // Package is a Go package.
@@ -98,9 +99,45 @@ type Package struct {
 	// directory containing its source files.
 	Name string
 
+	// Aliases are additional names to register the command under.
+	Aliases []string
+
 	// Pkg is the actual data about the package.
 	Pkg *packages.Package
 
+	// GODEBUG are the command's default GODEBUG settings, which are
+	// registered with bbmain.RegisterGODEBUG.
+	GODEBUG string
+
+	// BuildInfo is the command's build info as formatted by
+	// debug.BuildInfo.String. It is registered with
+	// bbmain.RegisterBuildInfo, and calls to debug.ReadBuildInfo are
+	// rewritten into calls to bbmain.ReadBuildInfo.
+	BuildInfo string
+
+	// LineDirectives configures how the rewritten files refer back to
+	// the original source files.
+	LineDirectives LineDirectives
+
+	// InterceptExits rewrites calls that exit the process, such as os.Exit
+	// and log.Fatal, into calls to bbmain, so that the command can run in
+	// bbmain.RunInProcess.
+	InterceptExits bool
+
+	// InterceptStdio rewrites references to os.Stdin, os.Stdout and
+	// os.Stderr into references to bbmain's variables, so that
+	// bbmain.Exec can give the command its own standard I/O.
+	InterceptStdio bool
+
+	// isDep is true for non-main dependency packages whose global side
+	// effects are deferred into an exported init function.
+	isDep bool
+
+	// rewrittenDeps are the dependencies of this package, by package ID,
+	// whose global side effects were deferred. Their init functions must
+	// be called before this package's init runs.
+	rewrittenDeps map[string]*Package
+
 	// initCount keeps track of what the next init's index should be.
 	initCount uint
 
@@ -109,8 +146,14 @@ type Package struct {
 
 	// init is the cmd.Init function that calls all other InitXs in the
 	// right order.
+	//
+	// For dependency packages, this is the exported init function.
 	init *ast.FuncDecl
 
+	// initDoneName is the name of the global that guards a dependency
+	// package's init from running more than once per command invocation.
+	initDoneName string
+
 	// initAssigns is a map of assignment expression -> InitN function call
 	// statement.
 	//
@@ -125,6 +168,19 @@ type Package struct {
 	//
 	// The key Expr must also be the AssignStmt.Rhs[0].
 	initAssigns map[ast.Expr]ast.Stmt
+
+	// zeroFuncs maps function shapes to the name of the generic helper
+	// returning the zero values of such a function's results.
+	zeroFuncs map[string]string
+
+	// resetFuncName is the name of the generic helper resetting a
+	// variable to its zero value, once it has been added.
+	resetFuncName string
+
+	// varResets are statements resetting global variables without
+	// initializer to their zero value, so that a command starts with the
+	// same state when its init runs again.
+	varResets []ast.Stmt
 }
 
 // NewPackage creates a new Package based on an existing packages.Package.
@@ -150,6 +206,75 @@ func NewPackage(name string, p *packages.Package) *Package {
 	return pp
 }
 
+// NewDepPackage creates a new Package for a non-main dependency package of a
+// busybox command.
+//
+// RewriteDep moves the package's init functions and global variable
+// initializers into an exported function named by InitFuncName, which
+// rewritten importers call from their own init.
+func NewDepPackage(p *packages.Package) *Package {
+	pp := &Package{
+		Name:        p.Name,
+		Pkg:         p,
+		isDep:       true,
+		initAssigns: make(map[ast.Expr]ast.Stmt),
+	}
+
+	pp.initDoneName = pp.newFunctionName("busyboxInitDone")
+
+	// This Init will hold calls to all other InitXs.
+	pp.init = &ast.FuncDecl{
+		Name: ast.NewIdent(pp.newFunctionName("BusyboxInit")),
+		Type: &ast.FuncType{
+			Params:  &ast.FieldList{},
+			Results: nil,
+		},
+		Body: &ast.BlockStmt{},
+	}
+	return pp
+}
+
+// InitFuncName is the name of the exported function that runs the deferred
+// initialization of a dependency package.
+func (p *Package) InitFuncName() string {
+	return p.init.Name.Name
+}
+
+// SetRewrittenDeps tells p which of its dependencies are rewritten with
+// RewriteDep, keyed by package ID.
+//
+// p's init calls the init functions of all of its rewritten imports before
+// its own initializers, preserving Go's package initialization order.
+func (p *Package) SetRewrittenDeps(deps map[string]*Package) {
+	p.rewrittenDeps = deps
+}
+
+// Deferrable returns an error if the global initialization of dependency
+// package p cannot be moved into a function by RewriteDep.
+func (p *Package) Deferrable() error {
+	for _, fp := range p.Pkg.OtherFiles {
+		// Assembly may refer to any global by symbol name.
+		if filepath.Ext(fp) == ".s" {
+			return fmt.Errorf("package contains assembly file %s", filepath.Base(fp))
+		}
+	}
+	for _, f := range p.Pkg.Syntax {
+		for _, impt := range f.Imports {
+			if impt.Path.Value == `"C"` {
+				return fmt.Errorf("package uses cgo")
+			}
+		}
+		for _, cg := range f.Comments {
+			for _, c := range cg.List {
+				if strings.HasPrefix(c.Text, "//go:linkname") {
+					return fmt.Errorf("package uses //go:linkname")
+				}
+			}
+		}
+	}
+	return p.checkTypeNames()
+}
+
 func (p *Package) nextInit(addToCallList bool) *ast.Ident {
 	nextInitName := fmt.Sprintf("busyboxInit%d", p.initCount)
 	for p.funcNameTaken(nextInitName) {
@@ -217,6 +342,13 @@ func (p *Package) pkgImportNameTaken(name string, f *ast.File) bool {
 	if p.Pkg.TypesInfo.Scopes[f].Lookup(name) != nil {
 		return true
 	}
+
+	// Imports added by the rewrite are not in the file scope.
+	for _, impt := range f.Imports {
+		if impt.Name != nil && impt.Name.Name == name {
+			return true
+		}
+	}
 	return false
 }
 
@@ -273,7 +405,9 @@ func (p *Package) rewriteFile(f *ast.File) bool {
 	// Change the package name declaration from main to the command's name.
 	// Remove all non-alphanumeric characters except for underscore and ensure
 	// starting with a letter. There are more valid identifiers though.
-	f.Name.Name = p.PackageName()
+	if !p.isDep {
+		f.Name.Name = p.PackageName()
+	}
 
 	// Map of fully qualified package name -> imported alias in the file.
 	importAliases := make(map[string]string)
@@ -340,50 +474,50 @@ func (p *Package) rewriteFile(f *ast.File) bool {
 			if d.Tok != token.VAR {
 				break
 			}
+			var specs []ast.Spec
 			for _, spec := range d.Specs {
 				s := spec.(*ast.ValueSpec)
 				if s.Values == nil {
+					if !p.isDep && !hasDirective(d.Doc) && !hasDirective(s.Doc) {
+						p.resetVars(s, f)
+					}
+					specs = append(specs, s)
 					continue
 				}
 
-				// For each assignment, create a new init
-				// function, and place it in the same file.
-				for i, name := range s.Names {
-					varInit := &ast.FuncDecl{
-						Name: p.nextInit(false),
-						Type: &ast.FuncType{
-							Params:  &ast.FieldList{},
-							Results: nil,
-						},
-						Body: &ast.BlockStmt{
-							List: []ast.Stmt{
-								&ast.AssignStmt{
-									Lhs: []ast.Expr{name},
-									Tok: token.ASSIGN,
-									Rhs: []ast.Expr{s.Values[i]},
-								},
-							},
-						},
+				if len(s.Names) > 1 && len(s.Values) == 1 {
+					// A single tuple-valued expression, e.g.
+					//
+					//   var a, b = f()
+					//   var x, ok = m[k]
+					//
+					// is assigned in one init function.
+					lhs := make([]ast.Expr, 0, len(s.Names))
+					for _, name := range s.Names {
+						lhs = append(lhs, name)
+					}
+					f.Decls = append(f.Decls, p.varInit(lhs, s.Values[0]))
+				} else {
+					// For each assignment, create a new init
+					// function, and place it in the same file.
+					for i, name := range s.Names {
+						f.Decls = append(f.Decls, p.varInit([]ast.Expr{name}, s.Values[i]))
 					}
-					// Add a call to the new init func to
-					// this map, so they can be added to
-					// Init0() in the correct init order
-					// later.
-					p.initAssigns[s.Values[i]] = &ast.ExprStmt{X: &ast.CallExpr{Fun: varInit.Name}}
-					f.Decls = append(f.Decls, varInit)
 				}
 
 				// Add the type of the expression to the global
 				// declaration instead.
 				if s.Type == nil {
-					typ := p.Pkg.TypesInfo.Types[s.Values[0]]
-					s.Type = ast.NewIdent(types.TypeString(typ.Type, qualifier))
+					specs = append(specs, p.typedSpecs(s, f, qualifier)...)
+				} else {
+					s.Values = nil
+					specs = append(specs, s)
 				}
-				s.Values = nil
 			}
+			d.Specs = specs
 
 		case *ast.FuncDecl:
-			if d.Recv == nil && d.Name.Name == "main" {
+			if !p.isDep && d.Recv == nil && d.Name.Name == "main" {
 				d.Name.Name = p.mainFuncName
 				hasMain = true
 			}
@@ -408,8 +542,182 @@ func (p *Package) rewriteFile(f *ast.File) bool {
 	return hasMain
 }
 
-// WritePkg writes p's files into destDir.
-func WritePkg(p *packages.Package, destDir string) error {
+// hasDirective returns true if cg contains a //go: directive, such as
+// //go:embed or //go:linkname.
+func hasDirective(cg *ast.CommentGroup) bool {
+	if cg == nil {
+		return false
+	}
+	for _, c := range cg.List {
+		if strings.HasPrefix(c.Text, "//go:") {
+			return true
+		}
+	}
+	return false
+}
+
+// resetVars adds statements resetting the variables declared by s to their
+// zero value to p.varResets, e.g.
+//
+//	busyboxReset(&x)
+//
+// The generic helper is added to f when first needed, as the types of the
+// variables may not be nameable.
+func (p *Package) resetVars(s *ast.ValueSpec, f *ast.File) {
+	for _, name := range s.Names {
+		if name.Name == "_" {
+			continue
+		}
+		if p.resetFuncName == "" {
+			p.resetFuncName = p.newFunctionName("busyboxReset")
+			// func busyboxReset[T any](v *T) { *v = *new(T) }
+			f.Decls = append(f.Decls, &ast.FuncDecl{
+				Name: ast.NewIdent(p.resetFuncName),
+				Type: &ast.FuncType{
+					TypeParams: &ast.FieldList{List: []*ast.Field{{
+						Names: []*ast.Ident{ast.NewIdent("T")},
+						Type:  ast.NewIdent("any"),
+					}}},
+					Params: &ast.FieldList{List: []*ast.Field{{
+						Names: []*ast.Ident{ast.NewIdent("v")},
+						Type:  &ast.StarExpr{X: ast.NewIdent("T")},
+					}}},
+				},
+				Body: &ast.BlockStmt{List: []ast.Stmt{&ast.AssignStmt{
+					Lhs: []ast.Expr{&ast.StarExpr{X: ast.NewIdent("v")}},
+					Tok: token.ASSIGN,
+					Rhs: []ast.Expr{&ast.StarExpr{X: &ast.CallExpr{
+						Fun:  ast.NewIdent("new"),
+						Args: []ast.Expr{ast.NewIdent("T")},
+					}}},
+				}}},
+			})
+		}
+		p.varResets = append(p.varResets, &ast.ExprStmt{X: &ast.CallExpr{
+			Fun:  ast.NewIdent(p.resetFuncName),
+			Args: []ast.Expr{&ast.UnaryExpr{Op: token.AND, X: ast.NewIdent(name.Name)}},
+		}})
+	}
+}
+
+// varInit returns a new init function assigning rhs to lhs.
+//
+// A call to the init function is added to p.initAssigns, so it can be added to
+// Init0() in the correct init order later.
+func (p *Package) varInit(lhs []ast.Expr, rhs ast.Expr) *ast.FuncDecl {
+	varInit := &ast.FuncDecl{
+		Name: p.nextInit(false),
+		Type: &ast.FuncType{
+			Params:  &ast.FieldList{},
+			Results: nil,
+		},
+		Body: &ast.BlockStmt{
+			List: []ast.Stmt{
+				&ast.AssignStmt{
+					Lhs: lhs,
+					Tok: token.ASSIGN,
+					Rhs: []ast.Expr{rhs},
+				},
+			},
+		},
+	}
+	p.initAssigns[rhs] = &ast.ExprStmt{X: &ast.CallExpr{Fun: varInit.Name}}
+	return varInit
+}
+
+// varType returns the type of the i-th variable declared by s.
+func (p *Package) varType(s *ast.ValueSpec, i int) types.Type {
+	if name := s.Names[i].Name; name != "_" {
+		if obj := p.Pkg.Types.Scope().Lookup(name); obj != nil {
+			return obj.Type()
+		}
+	}
+	if len(s.Values) == len(s.Names) {
+		return p.Pkg.TypesInfo.Types[s.Values[i]].Type
+	}
+	// Tuple-valued expressions, including comma-ok expressions, are
+	// recorded with a tuple type.
+	if tuple, ok := p.Pkg.TypesInfo.Types[s.Values[0]].Type.(*types.Tuple); ok && i < tuple.Len() {
+		return tuple.At(i).Type()
+	}
+	return nil
+}
+
+// typedSpecs returns declarations without values for the variables declared
+// by s, with each variable's type made explicit.
+//
+// Consecutive variables of the same type share one declaration. Variables
+// whose type cannot be named keep a declaration that infers their type, see
+// inferredSpec.
+func (p *Package) typedSpecs(s *ast.ValueSpec, f *ast.File, qualifier types.Qualifier) []ast.Spec {
+	if len(s.Values) != len(s.Names) {
+		for i := range s.Names {
+			if p.unnameableType(p.varType(s, i)) != nil {
+				return []ast.Spec{p.inferredSpec(s, f)}
+			}
+		}
+	}
+
+	var specs []ast.Spec
+	var last *ast.ValueSpec
+	var lastType string
+	for i, name := range s.Names {
+		typ := p.varType(s, i)
+		if p.unnameableType(typ) != nil {
+			last = nil
+			specs = append(specs, p.inferredSpec(&ast.ValueSpec{
+				Names:  []*ast.Ident{name},
+				Values: []ast.Expr{s.Values[i]},
+			}, f))
+			continue
+		}
+
+		typeString := types.TypeString(typ, qualifier)
+		if last != nil && typeString == lastType {
+			last.Names = append(last.Names, name)
+			continue
+		}
+		last = &ast.ValueSpec{
+			Names: []*ast.Ident{name},
+			Type:  ast.NewIdent(typeString),
+		}
+		lastType = typeString
+		specs = append(specs, last)
+	}
+	// Keep comments with the first declaration.
+	specs[0].(*ast.ValueSpec).Doc = s.Doc
+	specs[len(specs)-1].(*ast.ValueSpec).Comment = s.Comment
+	return specs
+}
+
+// LineDirectives configures the //line directives in written Go files, which
+// map positions in the generated source back to the original source files.
+//
+// With line directives, panics, compiler errors and go vet findings in a
+// busybox refer to the original file and line of the code, even if it was
+// moved around by the rewrite.
+type LineDirectives int
+
+const (
+	// LineDirectivesRelative refers to original source files by their base
+	// name. The generated file has the same base name, so only line
+	// numbers are changed and file names in the binary are still subject
+	// to -trimpath.
+	LineDirectivesRelative LineDirectives = iota
+
+	// LineDirectivesAbsolute refers to original source files by their
+	// absolute path.
+	LineDirectivesAbsolute
+
+	// LineDirectivesNone omits line directives.
+	LineDirectivesNone
+)
+
+// WritePkg writes p's files into destDir, printing Go files from p.Syntax.
+//
+// Go files are constrained to the language version of p's module, so that
+// they keep their semantics when compiled outside of it.
+func WritePkg(p *packages.Package, destDir string, lines LineDirectives) error {
 	// TODO(hugelgupf):
 	// - join errors
 	// - seems a bit late to check for these errors, but works for now --
@@ -418,13 +726,46 @@ func WritePkg(p *packages.Package, destDir string) error {
 	if len(p.Errors) > 0 {
 		return p.Errors[0]
 	}
+	if err := writeOtherFiles(p, destDir); err != nil {
+		return err
+	}
+	return writeFiles(destDir, p.Fset, p.Syntax, lines, LangVersion(p))
+}
+
+// CopyPkg copies p's files into destDir verbatim, for packages that need no
+// rewriting.
+//
+// Only Go files that need a constraint to the language version of p's module
+// are changed, by adding lines at the top as in WritePkg. A //line directive
+// keeps the following lines at their original position. With
+// LineDirectivesAbsolute, a //line directive names the original file.
+//
+// Read-only files, such as those in the module cache, are hard-linked where
+// possible, since they are not going to change.
+func CopyPkg(p *packages.Package, destDir string, lines LineDirectives) error {
+	if len(p.Errors) > 0 {
+		return p.Errors[0]
+	}
+	if err := writeOtherFiles(p, destDir); err != nil {
+		return err
+	}
+	lang := LangVersion(p)
+	for _, fp := range p.GoFiles {
+		if err := copyGoFile(fp, filepath.Join(destDir, filepath.Base(fp)), lines, lang); err != nil {
+			return err
+		}
+	}
+	return nil
+}
 
+// writeOtherFiles copies p's non-Go files and embedded files into destDir.
+func writeOtherFiles(p *packages.Package, destDir string) error {
 	if err := os.MkdirAll(destDir, 0755); err != nil {
 		return err
 	}
 
 	for _, fp := range p.OtherFiles {
-		if err := cp.Copy(fp, filepath.Join(destDir, filepath.Base(fp))); err != nil {
+		if err := linkOrCopy(fp, filepath.Join(destDir, filepath.Base(fp))); err != nil {
 			return fmt.Errorf("copy failed: %v", err)
 		}
 	}
@@ -453,34 +794,77 @@ func WritePkg(p *packages.Package, destDir string) error {
 			return err
 		}
 		os.MkdirAll(filepath.Join(destDir, filepath.Dir(relPath)), 0755)
-		if err := cp.Copy(fp, filepath.Join(destDir, relPath)); err != nil {
+		if err := linkOrCopy(fp, filepath.Join(destDir, relPath)); err != nil {
 			return fmt.Errorf("copy failed: %v", err)
 		}
 	}
+	return nil
+}
 
-	return writeFiles(destDir, p.Fset, p.Syntax)
+// copyGoFile copies the Go file at src to dst, constrained to language
+// version lang. See CopyPkg.
+func copyGoFile(src, dst string, lines LineDirectives, lang string) error {
+	code, err := os.ReadFile(src)
+	if err != nil {
+		return err
+	}
+	var lineFile string
+	switch lines {
+	case LineDirectivesRelative:
+		lineFile = filepath.Base(src)
+	case LineDirectivesAbsolute:
+		lineFile = src
+	}
+	out, err := constrainLang(code, lang, lineFile)
+	if err != nil {
+		return fmt.Errorf("error constraining Go file %q to %s: %v", src, lang, err)
+	}
+	if lines == LineDirectivesAbsolute && bytes.Count(out, []byte("\n")) == bytes.Count(code, []byte("\n")) {
+		// No lines were added, and with them no //line directive.
+		out = append([]byte(fmt.Sprintf("//line %s:1\n", src)), out...)
+	}
+	if bytes.Equal(out, code) {
+		return linkOrCopy(src, dst)
+	}
+	return os.WriteFile(dst, out, 0o644)
+}
+
+// linkOrCopy hard-links src to dst if src is read-only, or copies it.
+//
+// Writable files are copied, as they may be changed in place later, and
+// generated trees may be cached.
+func linkOrCopy(src, dst string) error {
+	fi, err := os.Stat(src)
+	if err != nil {
+		return err
+	}
+	if fi.Mode().IsRegular() && fi.Mode().Perm()&0o222 == 0 {
+		if err := os.Link(src, dst); err == nil {
+			return nil
+		}
+	}
+	return cp.Copy(src, dst)
 }
 
-func writeFiles(destDir string, fset *token.FileSet, files []*ast.File) error {
+func writeFiles(destDir string, fset *token.FileSet, files []*ast.File, lines LineDirectives, lang string) error {
 	// Write all files out.
 	for _, file := range files {
 		name := fset.File(file.Package).Name()
 
 		path := filepath.Join(destDir, filepath.Base(name))
-		if err := writeFile(path, fset, file); err != nil {
+		if err := writeFile(path, fset, file, lines, lang); err != nil {
 			return err
 		}
 	}
 	return nil
 }
 
-// Rewrite rewrites p into destDir as a bb package, rewriting its init and main
-// functions.
+// rewriteInits moves the global side effects of all of p's files into
+// functions called by p.init in Go's initialization order.
 //
-// bbImportPath is the importpath to use for bbmain. bbImportPath is usually
-// bb.u-root.com/bb/pkg/bbmain for the Go module/vendor-based compilations, but
-// github.com/u-root/gobusybox/src/pkg/bb/bbmain for bazel-based compilations.
-func (p *Package) Rewrite(destDir, bbImportPath string) error {
+// It returns the function holding global variable initializations and the
+// file containing main, if any.
+func (p *Package) rewriteInits() (*ast.FuncDecl, *ast.File, error) {
 	// This init holds all variable initializations.
 	//
 	// func init0() {}
@@ -493,69 +877,268 @@ func (p *Package) Rewrite(destDir, bbImportPath string) error {
 		Body: &ast.BlockStmt{},
 	}
 
+	// Check before any rewriting, so that no partially rewritten package
+	// is left behind.
+	if err := p.checkTypeNames(); err != nil {
+		return nil, nil, err
+	}
+
 	var mainFile *ast.File
 	for _, sourceFile := range p.Pkg.Syntax {
 		if hasMainFile := p.rewriteFile(sourceFile); hasMainFile {
 			mainFile = sourceFile
 		}
 	}
-	if mainFile == nil {
-		return fmt.Errorf("no main function found in package %q", p.Pkg.PkgPath)
-	}
+
+	// Variables without initializer are reset first, as initializers
+	// may assign to them.
+	varInit.Body.List = append(varInit.Body.List, p.varResets...)
 
 	// Add variable initializations to Init0 in the right order.
 	for _, initStmt := range p.Pkg.TypesInfo.InitOrder {
 		a, ok := p.initAssigns[initStmt.Rhs]
 		if !ok {
-			return fmt.Errorf("couldn't find init assignment %s", initStmt)
+			return nil, nil, fmt.Errorf("couldn't find init assignment %s", initStmt)
 		}
 		varInit.Body.List = append(varInit.Body.List, a)
 	}
+	return varInit, mainFile, nil
+}
+
+// importInits returns calls to the init functions of all rewritten packages
+// imported by p, adding imports for them to f as necessary.
+//
+// Go initializes imported packages before the importing package, so these
+// calls must precede p's own initializers.
+func (p *Package) importInits(f *ast.File) []ast.Stmt {
+	// Sort for deterministic output.
+	importPaths := make([]string, 0, len(p.Pkg.Imports))
+	for importPath := range p.Pkg.Imports {
+		importPaths = append(importPaths, importPath)
+	}
+	sort.Strings(importPaths)
+
+	var calls []ast.Stmt
+	for _, importPath := range importPaths {
+		dep, ok := p.rewrittenDeps[p.Pkg.Imports[importPath].ID]
+		if !ok {
+			continue
+		}
+		importName, ok := fileImportName(f, importPath, dep.Pkg.Name)
+		if !ok {
+			importName = p.newImportName("bbdep"+pnameRegex.ReplaceAllString(dep.Pkg.Name, ""), f)
+			astutil.AddNamedImport(p.Pkg.Fset, f, importName, importPath)
+		}
+		calls = append(calls, &ast.ExprStmt{X: &ast.CallExpr{
+			Fun: ast.NewIdent(fmt.Sprintf("%s.%s", importName, dep.InitFuncName())),
+		}})
+	}
+	return calls
+}
+
+// fileImportName returns the name under which f imports importPath, if it
+// does so with a usable name.
+func fileImportName(f *ast.File, importPath, pkgName string) (string, bool) {
+	for _, impt := range f.Imports {
+		if path, err := strconv.Unquote(impt.Path.Value); err != nil || path != importPath {
+			continue
+		}
+		if impt.Name == nil {
+			return pkgName, true
+		}
+		if impt.Name.Name != "_" && impt.Name.Name != "." {
+			return impt.Name.Name, true
+		}
+	}
+	return "", false
+}
+
+// Rewrite rewrites p into destDir as a bb package, rewriting its init and main
+// functions.
+//
+// bbImportPath is the importpath to use for bbmain. bbImportPath is usually
+// bb.u-root.com/bb/pkg/bbmain for the Go module/vendor-based compilations, but
+// github.com/u-root/gobusybox/src/pkg/bb/bbmain for bazel-based compilations.
+func (p *Package) Rewrite(destDir, bbImportPath string) error {
+	varInit, mainFile, err := p.rewriteInits()
+	if err != nil {
+		return err
+	}
+	if mainFile == nil {
+		return fmt.Errorf("no main function found in package %q", p.Pkg.PkgPath)
+	}
+	p.init.Body.List = append(p.importInits(mainFile), p.init.Body.List...)
+	for _, f := range p.Pkg.Syntax {
+		// Commands may call bbmain themselves, e.g. bbmain.Exec.
+		astutil.RewriteImport(p.Pkg.Fset, f, "github.com/u-root/gobusybox/src/pkg/bb/bbmain", bbImportPath)
+		if p.InterceptExits || p.InterceptStdio || p.BuildInfo != "" {
+			p.intercept(f, bbImportPath)
+		}
+	}
 
 	// import bbmain "bbImportPath"
-	importName := p.newImportName("bbmain", mainFile)
-	astutil.AddNamedImport(p.Pkg.Fset, mainFile, importName, bbImportPath)
+	importName, ok := fileImportName(mainFile, bbImportPath, "bbmain")
+	if !ok {
+		importName = p.newImportName("bbmain", mainFile)
+		astutil.AddNamedImport(p.Pkg.Fset, mainFile, importName, bbImportPath)
+	}
 
 	// func init() {
 	//   bbmain.Register("p.name", Init, Main)
+	//   bbmain.RegisterGODEBUG("p.name", "p.GODEBUG")
+	//   bbmain.RegisterBuildInfo("p.name", "p.BuildInfo")
+	//   bbmain.Register("alias", Init, Main)
+	//   ...
 	// }
 	bbRegisterSelf := &ast.FuncDecl{
 		Name: ast.NewIdent("init"),
 		Type: &ast.FuncType{},
-		Body: &ast.BlockStmt{
-			List: []ast.Stmt{
-				&ast.ExprStmt{X: &ast.CallExpr{
-					Fun: ast.NewIdent(fmt.Sprintf("%s.Register", importName)),
-					Args: []ast.Expr{
-						// name=
-						&ast.BasicLit{
-							Kind:  token.STRING,
-							Value: strconv.Quote(p.Name),
-						},
-						// init=
-						ast.NewIdent(p.init.Name.Name),
-						// main=
-						ast.NewIdent(p.mainFuncName),
-					},
-				}},
+		Body: &ast.BlockStmt{},
+	}
+	for _, name := range append([]string{p.Name}, p.Aliases...) {
+		bbRegisterSelf.Body.List = append(bbRegisterSelf.Body.List, &ast.ExprStmt{X: &ast.CallExpr{
+			Fun: ast.NewIdent(fmt.Sprintf("%s.Register", importName)),
+			Args: []ast.Expr{
+				// name=
+				&ast.BasicLit{
+					Kind:  token.STRING,
+					Value: strconv.Quote(name),
+				},
+				// init=
+				ast.NewIdent(p.init.Name.Name),
+				// main=
+				ast.NewIdent(p.mainFuncName),
 			},
-		},
+		}})
+		for _, r := range []struct{ fn, value string }{
+			{"RegisterGODEBUG", p.GODEBUG},
+			{"RegisterBuildInfo", p.BuildInfo},
+		} {
+			if r.value == "" {
+				continue
+			}
+			bbRegisterSelf.Body.List = append(bbRegisterSelf.Body.List, &ast.ExprStmt{X: &ast.CallExpr{
+				Fun: ast.NewIdent(fmt.Sprintf("%s.%s", importName, r.fn)),
+				Args: []ast.Expr{
+					&ast.BasicLit{Kind: token.STRING, Value: strconv.Quote(name)},
+					&ast.BasicLit{Kind: token.STRING, Value: strconv.Quote(r.value)},
+				},
+			}})
+		}
 	}
 
 	mainFile.Decls = append(mainFile.Decls, varInit, p.init, bbRegisterSelf)
 
-	return WritePkg(p.Pkg, destDir)
+	return WritePkg(p.Pkg, destDir, p.LineDirectives)
+}
+
+// RewriteDep rewrites dependency package p into destDir, deferring its init
+// functions and global variable initializations into an exported function
+// named by InitFuncName.
+//
+// The init function runs at most once per command invocation, as decided by
+// bbmain.InitDep, and calls the init functions of rewritten imports first, so
+// it may be called by every command that (transitively) depends on p.
+//
+// bbImportPath is the import path of bbmain, as for Rewrite.
+func (p *Package) RewriteDep(destDir, bbImportPath string) error {
+	if !p.isDep {
+		return fmt.Errorf("package %q is not a dependency package", p.Pkg.PkgPath)
+	}
+	if len(p.Pkg.Syntax) == 0 {
+		return WritePkg(p.Pkg, destDir, p.LineDirectives)
+	}
+	varInit, _, err := p.rewriteInits()
+	if err != nil {
+		return err
+	}
+	initFile := p.Pkg.Syntax[0]
+
+	// import bbmain "bbImportPath"
+	importName, ok := fileImportName(initFile, bbImportPath, "bbmain")
+	if !ok {
+		importName = p.newImportName("bbmain", initFile)
+		astutil.AddNamedImport(p.Pkg.Fset, initFile, importName, bbImportPath)
+	}
+
+	// var busyboxInitDone int
+	initDone := &ast.GenDecl{
+		Tok: token.VAR,
+		Specs: []ast.Spec{&ast.ValueSpec{
+			Names: []*ast.Ident{ast.NewIdent(p.initDoneName)},
+			Type:  ast.NewIdent("int"),
+		}},
+	}
+
+	// if !bbmain.InitDep(&busyboxInitDone) {
+	//   return
+	// }
+	guard := []ast.Stmt{
+		&ast.IfStmt{
+			Cond: &ast.UnaryExpr{
+				Op: token.NOT,
+				X: &ast.CallExpr{
+					Fun:  ast.NewIdent(fmt.Sprintf("%s.InitDep", importName)),
+					Args: []ast.Expr{&ast.UnaryExpr{Op: token.AND, X: ast.NewIdent(p.initDoneName)}},
+				},
+			},
+			Body: &ast.BlockStmt{List: []ast.Stmt{&ast.ReturnStmt{}}},
+		},
+	}
+	body := append(guard, p.importInits(initFile)...)
+	p.init.Body.List = append(body, p.init.Body.List...)
+
+	initFile.Decls = append(initFile.Decls, initDone, varInit, p.init)
+	return WritePkg(p.Pkg, destDir, p.LineDirectives)
 }
 
-func writeFile(path string, fset *token.FileSet, f *ast.File) error {
+func writeFile(path string, fset *token.FileSet, f *ast.File, lines LineDirectives, lang string) error {
+	// Same configuration as format.Node.
+	cfg := printer.Config{Mode: printer.UseSpaces | printer.TabIndent, Tabwidth: 8}
+	if lines != LineDirectivesNone {
+		cfg.Mode |= printer.SourcePos
+		ast.SortImports(fset, f)
+	}
 	var buf bytes.Buffer
-	if err := format.Node(&buf, fset, f); err != nil {
+	if err := cfg.Fprint(&buf, fset, f); err != nil {
 		return fmt.Errorf("error formatting Go file %q: %v", path, err)
 	}
-	return writeGoFile(path, buf.Bytes())
+	code := buf.Bytes()
+
+	var lineFile string
+	switch lines {
+	case LineDirectivesRelative:
+		// Relative //line file names are relative to the directory of
+		// the file they are in. The written file has the same base
+		// name as the original, so this keeps file names as they
+		// are and only fixes up line numbers.
+		orig := fset.File(f.Package).Name()
+		lineFile = filepath.Base(orig)
+		code = bytes.ReplaceAll(code, []byte("//line "+orig+":"), []byte("//line "+lineFile+":"))
+	case LineDirectivesAbsolute:
+		lineFile = fset.File(f.Package).Name()
+	}
+	if lines != LineDirectivesNone {
+		// goimports would add lines between import groups, moving
+		// code relative to the line directives. gofmt only moves
+		// lines when sorting imports, which we did before printing.
+		code, err := format.Source(code)
+		if err != nil {
+			return fmt.Errorf("error formatting Go file %q: %v", path, err)
+		}
+		code, err = constrainLang(code, lang, lineFile)
+		if err != nil {
+			return fmt.Errorf("error constraining Go file %q to %s: %v", path, lang, err)
+		}
+		if err := ioutil.WriteFile(path, code, 0644); err != nil {
+			return fmt.Errorf("error writing Go file to %q: %v", path, err)
+		}
+		return nil
+	}
+	return writeGoFile(path, code, lang)
 }
 
-func writeGoFile(path string, code []byte) error {
+func writeGoFile(path string, code []byte, lang string) error {
 	// Format the file. Do not fix up imports, as we only moved code around
 	// within files.
 	opts := imports.Options{
@@ -568,6 +1151,10 @@ func writeGoFile(path string, code []byte) error {
 	if err != nil {
 		return fmt.Errorf("bad parse while processing imports %q: %v", path, err)
 	}
+	code, err = constrainLang(code, lang, "")
+	if err != nil {
+		return fmt.Errorf("error constraining Go file %q to %s: %v", path, lang, err)
+	}
 
 	if err := ioutil.WriteFile(path, code, 0644); err != nil {
 		return fmt.Errorf("error writing Go file to %q: %v", path, err)
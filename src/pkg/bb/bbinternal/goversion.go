@@ -0,0 +1,140 @@
+// Copyright 2024 the u-root Authors. All rights reserved
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package bbinternal
+
+import (
+	"bytes"
+	"fmt"
+	"go/build/constraint"
+	"strings"
+
+	"golang.org/x/mod/semver"
+	"golang.org/x/tools/go/packages"
+)
+
+// LangVersion returns the Go language version of p's module as a build tag,
+// e.g. go1.21, or "" if p is not in a module.
+func LangVersion(p *packages.Package) string {
+	m := p.Module
+	if m == nil {
+		return ""
+	}
+	if m.Replace != nil && m.Replace.GoVersion != "" {
+		m = m.Replace
+	}
+	v := m.GoVersion
+	if v == "" {
+		// The go command assumes modules without a go directive to be
+		// written for Go 1.16.
+		v = "1.16"
+	}
+	return Lang(v)
+}
+
+// Lang returns the language version of Go version v as a build tag, e.g.
+// go1.21 for 1.21.3, go1.21.3 or go1.21rc1, or "" if v is not a Go version.
+func Lang(v string) string {
+	major, rest, ok := strings.Cut(strings.TrimPrefix(v, "go"), ".")
+	if !ok || major != "1" {
+		return ""
+	}
+	minor := rest
+	if i := strings.IndexFunc(rest, func(r rune) bool { return r < '0' || r > '9' }); i >= 0 {
+		minor = rest[:i]
+	}
+	if minor == "" {
+		return ""
+	}
+	return "go1." + minor
+}
+
+// CompareLang compares language versions a and b as returned by Lang,
+// returning -1, 0 or +1 like strings.Compare.
+func CompareLang(a, b string) int {
+	return semver.Compare("v"+strings.TrimPrefix(a, "go"), "v"+strings.TrimPrefix(b, "go"))
+}
+
+// constrainLang returns Go source code with a //go:build constraint requiring
+// language version lang, e.g. go1.21.
+//
+// Since Go 1.21, a file's //go:build go1.N constraint sets its language
+// version, even below the main module's. This keeps e.g. the for-loop
+// variable semantics of modules written for Go before 1.22 when they are
+// compiled together with newer code.
+//
+// An existing //go:build line is extended. If there is none, any // +build
+// lines are carried over into the new //go:build line, as they are ignored in
+// its presence. When lines are added, a //line directive naming lineFile is
+// added to keep the package clause and everything after it at their original
+// line. No directive is added if lineFile is empty.
+func constrainLang(code []byte, lang, lineFile string) ([]byte, error) {
+	if lang == "" {
+		return code, nil
+	}
+	lines := bytes.SplitAfter(code, []byte("\n"))
+
+	goBuild := -1
+	var plusBuild []int
+	hasLineDirective := false
+	pkgClause := len(lines)
+	for i, line := range lines {
+		l := string(bytes.TrimSpace(line))
+		if l == "" {
+			continue
+		}
+		if !strings.HasPrefix(l, "//") {
+			pkgClause = i
+			break
+		}
+		switch {
+		case constraint.IsGoBuild(l):
+			goBuild = i
+		case constraint.IsPlusBuild(l):
+			plusBuild = append(plusBuild, i)
+		case strings.HasPrefix(l, "//line "):
+			hasLineDirective = true
+		}
+	}
+
+	var x constraint.Expr = &constraint.TagExpr{Tag: lang}
+	if goBuild >= 0 {
+		y, err := constraint.Parse(string(bytes.TrimSpace(lines[goBuild])))
+		if err != nil {
+			return nil, err
+		}
+		if v := constraint.GoVersion(y); v != "" && CompareLang(v, lang) >= 0 {
+			// The file already requires this or a later version.
+			return code, nil
+		}
+		lines[goBuild] = []byte(fmt.Sprintf("//go:build %s\n", &constraint.AndExpr{X: x, Y: y}))
+		return bytes.Join(lines, nil), nil
+	}
+
+	var insertAt int
+	var insert []byte
+	if len(plusBuild) > 0 {
+		for _, i := range plusBuild {
+			y, err := constraint.Parse(string(bytes.TrimSpace(lines[i])))
+			if err != nil {
+				return nil, err
+			}
+			x = &constraint.AndExpr{X: x, Y: y}
+		}
+		insertAt = plusBuild[0]
+		insert = []byte(fmt.Sprintf("//go:build %s\n", x))
+	} else {
+		insert = []byte(fmt.Sprintf("//go:build %s\n\n", x))
+	}
+
+	var out [][]byte
+	out = append(out, lines[:insertAt]...)
+	out = append(out, insert)
+	out = append(out, lines[insertAt:pkgClause]...)
+	if lineFile != "" && !hasLineDirective {
+		out = append(out, []byte(fmt.Sprintf("//line %s:%d\n", lineFile, pkgClause+1)))
+	}
+	out = append(out, lines[pkgClause:]...)
+	return bytes.Join(out, nil), nil
+}
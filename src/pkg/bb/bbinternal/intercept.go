@@ -0,0 +1,284 @@
+// Copyright 2024 the u-root Authors. All rights reserved
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package bbinternal
+
+import (
+	"fmt"
+	"go/ast"
+	"go/token"
+	"go/types"
+	"strconv"
+
+	"golang.org/x/tools/go/ast/astutil"
+)
+
+// exitFuncs maps package-level functions that exit the process to the bbmain
+// function replacing them.
+var exitFuncs = map[string]map[string]string{
+	"os": {
+		"Exit": "Exit",
+	},
+	"log": {
+		"Fatal":   "LogFatal",
+		"Fatalf":  "LogFatalf",
+		"Fatalln": "LogFatalln",
+	},
+	"flag": {
+		"Parse":      "ParseFlags",
+		"NewFlagSet": "NewFlagSet",
+	},
+}
+
+// stdioVars maps the standard I/O files to the bbmain variables replacing
+// them.
+var stdioVars = map[string]map[string]string{
+	"os": {
+		"Stdin":  "Stdin",
+		"Stdout": "Stdout",
+		"Stderr": "Stderr",
+	},
+}
+
+// stdioFuncs maps functions that use the standard I/O files implicitly to
+// the function taking them as first argument instead.
+var stdioFuncs = map[string]map[string]string{
+	"fmt": {
+		"Print":   "Fprint",
+		"Printf":  "Fprintf",
+		"Println": "Fprintln",
+	},
+}
+
+// buildInfoFuncs maps functions returning the binary's build info to the
+// bbmain function returning the command's instead.
+var buildInfoFuncs = map[string]map[string]string{
+	"runtime/debug": {
+		"ReadBuildInfo": "ReadBuildInfo",
+	},
+}
+
+// exitMethods maps methods that exit the process to the bbmain function
+// replacing them, which takes the receiver as first argument.
+var exitMethods = map[string]map[string]string{
+	"log.Logger": {
+		"Fatal":   "LoggerFatal",
+		"Fatalf":  "LoggerFatalf",
+		"Fatalln": "LoggerFatalln",
+	},
+	"flag.FlagSet": {
+		"Parse": "ParseFlagSet",
+	},
+}
+
+// interceptedIdent returns the bbmain identifier replacing the qualified
+// identifier sel, if p intercepts it.
+func (p *Package) interceptedIdent(sel *ast.SelectorExpr) string {
+	id, ok := sel.X.(*ast.Ident)
+	if !ok {
+		return ""
+	}
+	pkgName, ok := p.Pkg.TypesInfo.Uses[id].(*types.PkgName)
+	if !ok {
+		return ""
+	}
+	path := pkgName.Imported().Path()
+	if p.InterceptExits {
+		if fn, ok := exitFuncs[path][sel.Sel.Name]; ok {
+			return fn
+		}
+	}
+	if p.InterceptStdio {
+		if v, ok := stdioVars[path][sel.Sel.Name]; ok {
+			return v
+		}
+	}
+	if p.BuildInfo != "" {
+		if fn, ok := buildInfoFuncs[path][sel.Sel.Name]; ok {
+			return fn
+		}
+	}
+	return ""
+}
+
+// stdioFunc returns the function replacing the qualified identifier sel and
+// the bbmain variable it takes as first argument, if sel is a function that
+// implicitly writes to os.Stdout.
+func (p *Package) stdioFunc(sel *ast.SelectorExpr) (string, string) {
+	if !p.InterceptStdio {
+		return "", ""
+	}
+	id, ok := sel.X.(*ast.Ident)
+	if !ok {
+		return "", ""
+	}
+	pkgName, ok := p.Pkg.TypesInfo.Uses[id].(*types.PkgName)
+	if !ok {
+		return "", ""
+	}
+	if fn, ok := stdioFuncs[pkgName.Imported().Path()][sel.Sel.Name]; ok {
+		return fn, "Stdout"
+	}
+	return "", ""
+}
+
+// exitMethod returns the bbmain function replacing the method selected by sel
+// and the kind of selection, if sel selects a method that exits the process,
+// either as method value, e.g. l.Fatal, or as method expression, e.g.
+// (*log.Logger).Fatal.
+func (p *Package) exitMethod(sel *ast.SelectorExpr) (string, types.SelectionKind) {
+	if !p.InterceptExits {
+		return "", 0
+	}
+	s, ok := p.Pkg.TypesInfo.Selections[sel]
+	if !ok || (s.Kind() != types.MethodVal && s.Kind() != types.MethodExpr) {
+		return "", 0
+	}
+	recv := s.Recv()
+	if ptr, ok := recv.(*types.Pointer); ok {
+		recv = ptr.Elem()
+	}
+	named, ok := recv.(*types.Named)
+	if !ok || named.Obj().Pkg() == nil {
+		return "", 0
+	}
+	typeName := fmt.Sprintf("%s.%s", named.Obj().Pkg().Path(), named.Obj().Name())
+	fn, ok := exitMethods[typeName][sel.Sel.Name]
+	if !ok {
+		return "", 0
+	}
+	return fn, s.Kind()
+}
+
+// intercept rewrites references in f to process-wide state to the bbmain
+// package at bbImportPath, so that bbmain can run the command in process.
+//
+// With InterceptExits, calls that exit the process are replaced: os.Exit,
+// log.Fatal* and (*log.Logger).Fatal*, as well as flag.Parse,
+// flag.NewFlagSet and (*flag.FlagSet).Parse to deal with flag.ExitOnError.
+// Method values of these methods, e.g. `fatal := l.Fatal`, are replaced by
+// the value bbmain's corresponding *Func function returns, which binds the
+// receiver like the method value does.
+//
+// With InterceptStdio, os.Stdin, os.Stdout and os.Stderr are replaced by
+// bbmain's variables of the same name, and fmt.Print* by fmt.Fprint* writing
+// to bbmain.Stdout.
+//
+// With BuildInfo, debug.ReadBuildInfo is replaced by bbmain.ReadBuildInfo.
+func (p *Package) intercept(f *ast.File, bbImportPath string) {
+	// The bbmain import name is only known once all uses are known.
+	var (
+		sites []token.Pos
+		names []*ast.Ident
+	)
+	bbmainIdent := func(pos token.Pos, name string) *ast.SelectorExpr {
+		sites = append(sites, pos)
+		// Keep the original position for line directives.
+		id := &ast.Ident{NamePos: pos, Name: "bbmain"}
+		names = append(names, id)
+		return &ast.SelectorExpr{X: id, Sel: &ast.Ident{NamePos: pos, Name: name}}
+	}
+	astutil.Apply(f, nil, func(c *astutil.Cursor) bool {
+		switch n := c.Node().(type) {
+		case *ast.SelectorExpr:
+			// Qualified identifiers, also when not called, e.g.
+			// `exit := os.Exit`.
+			if fn := p.interceptedIdent(n); fn != "" {
+				c.Replace(bbmainIdent(n.Pos(), fn))
+				break
+			}
+			fn, kind := p.exitMethod(n)
+			switch {
+			case fn == "":
+			case kind == types.MethodExpr:
+				// (*log.Logger).Fatal -> bbmain.LoggerFatal
+				c.Replace(bbmainIdent(n.Pos(), fn))
+			case c.Name() == "Fun":
+				// Method calls are replaced with their call below.
+			default:
+				// l.Fatal -> bbmain.LoggerFatalFunc(l)
+				c.Replace(&ast.CallExpr{
+					Fun:  bbmainIdent(n.Pos(), fn+"Func"),
+					Args: []ast.Expr{n.X},
+				})
+			}
+
+		case *ast.CallExpr:
+			// Method calls become function calls with the receiver
+			// as first argument.
+			sel, ok := n.Fun.(*ast.SelectorExpr)
+			if !ok {
+				break
+			}
+			if fn, v := p.stdioFunc(sel); fn != "" {
+				// fmt.Println(x) -> fmt.Fprintln(bbmain.Stdout, x)
+				c.Replace(&ast.CallExpr{
+					Fun:      &ast.SelectorExpr{X: sel.X, Sel: &ast.Ident{NamePos: sel.Sel.Pos(), Name: fn}},
+					Args:     append([]ast.Expr{bbmainIdent(n.Pos(), v)}, n.Args...),
+					Ellipsis: n.Ellipsis,
+				})
+			} else if fn, kind := p.exitMethod(sel); kind == types.MethodVal {
+				c.Replace(&ast.CallExpr{
+					Fun:      bbmainIdent(n.Pos(), fn),
+					Args:     append([]ast.Expr{sel.X}, n.Args...),
+					Ellipsis: n.Ellipsis,
+				})
+			}
+		}
+		return true
+	})
+	if len(sites) == 0 {
+		return
+	}
+
+	// The import name must not be shadowed wherever it is used.
+	name, ok := fileImportName(f, bbImportPath, "bbmain")
+	if !ok {
+		var i int
+		name = "bbmain"
+		for p.pkgImportNameTaken(name, f) || p.shadowed(name, sites) {
+			name = fmt.Sprintf("bbmain%d", i)
+			i++
+		}
+		astutil.AddNamedImport(p.Pkg.Fset, f, name, bbImportPath)
+	}
+	for _, id := range names {
+		id.Name = name
+	}
+
+	// Imports only used for intercepted identifiers are now unused.
+	for _, impt := range append([]*ast.ImportSpec(nil), f.Imports...) {
+		path, err := strconv.Unquote(impt.Path.Value)
+		if err != nil || (impt.Name != nil && (impt.Name.Name == "_" || impt.Name.Name == ".")) {
+			continue
+		}
+		_, exits := exitFuncs[path]
+		_, stdio := stdioVars[path]
+		_, info := buildInfoFuncs[path]
+		if (!exits && !stdio && !info) || astutil.UsesImport(f, path) {
+			continue
+		}
+		if impt.Name != nil {
+			astutil.DeleteNamedImport(p.Pkg.Fset, f, impt.Name.Name, path)
+		} else {
+			astutil.DeleteImport(p.Pkg.Fset, f, path)
+		}
+	}
+}
+
+// shadowed returns true if name refers to a declared object at any of the
+// given positions.
+func (p *Package) shadowed(name string, sites []token.Pos) bool {
+	scope := p.Pkg.Types.Scope()
+	for _, pos := range sites {
+		inner := scope.Innermost(pos)
+		if inner == nil {
+			continue
+		}
+		if _, obj := inner.LookupParent(name, pos); obj != nil {
+			return true
+		}
+	}
+	return false
+}
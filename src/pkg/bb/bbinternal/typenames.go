@@ -0,0 +1,318 @@
+// Copyright 2024 the u-root Authors. All rights reserved
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package bbinternal
+
+import (
+	"fmt"
+	"go/ast"
+	"go/token"
+	"go/types"
+	"strings"
+)
+
+// unnameableType returns the first type referenced by typ that cannot be
+// spelled out in p's source, or nil if typ can be named in p.
+//
+// Unexported types of other packages, types of internal packages p may not
+// import, and types declared inside functions cannot be named.
+func (p *Package) unnameableType(typ types.Type) types.Type {
+	// Aliases such as any are named like the types they denote, as far as
+	// they can be named at all.
+	switch t := unalias(typ).(type) {
+	case *types.Basic:
+		return nil
+
+	case *types.Pointer:
+		return p.unnameableType(t.Elem())
+
+	case *types.Slice:
+		return p.unnameableType(t.Elem())
+
+	case *types.Array:
+		return p.unnameableType(t.Elem())
+
+	case *types.Chan:
+		return p.unnameableType(t.Elem())
+
+	case *types.Map:
+		if u := p.unnameableType(t.Key()); u != nil {
+			return u
+		}
+		return p.unnameableType(t.Elem())
+
+	case *types.Tuple:
+		for i := 0; i < t.Len(); i++ {
+			if u := p.unnameableType(t.At(i).Type()); u != nil {
+				return u
+			}
+		}
+		return nil
+
+	case *types.Signature:
+		if u := p.unnameableType(t.Params()); u != nil {
+			return u
+		}
+		return p.unnameableType(t.Results())
+
+	case *types.Struct:
+		for i := 0; i < t.NumFields(); i++ {
+			f := t.Field(i)
+			// Unexported field names are qualified by their package.
+			if !f.Exported() && f.Pkg() != p.Pkg.Types {
+				return t
+			}
+			if u := p.unnameableType(f.Type()); u != nil {
+				return u
+			}
+		}
+		return nil
+
+	case *types.Interface:
+		for i := 0; i < t.NumExplicitMethods(); i++ {
+			m := t.ExplicitMethod(i)
+			if !m.Exported() && m.Pkg() != p.Pkg.Types {
+				return t
+			}
+			if u := p.unnameableType(m.Type()); u != nil {
+				return u
+			}
+		}
+		for i := 0; i < t.NumEmbeddeds(); i++ {
+			if u := p.unnameableType(t.EmbeddedType(i)); u != nil {
+				return u
+			}
+		}
+		return nil
+
+	case *types.Named:
+		obj := t.Obj()
+		// Predeclared, e.g. error.
+		if obj.Pkg() == nil {
+			return nil
+		}
+		if obj.Pkg() == p.Pkg.Types {
+			if obj.Parent() != obj.Pkg().Scope() {
+				return t
+			}
+		} else if !obj.Exported() || !canImport(p.Pkg.PkgPath, obj.Pkg().Path()) {
+			return t
+		}
+		if args := t.TypeArgs(); args != nil {
+			for i := 0; i < args.Len(); i++ {
+				if u := p.unnameableType(args.At(i)); u != nil {
+					return u
+				}
+			}
+		}
+		return nil
+
+	default:
+		// Type parameters and anything we don't know about.
+		return t
+	}
+}
+
+// canImport applies Go's internal package rule to decide whether the package
+// at importer may import the package at path.
+func canImport(importer, path string) bool {
+	var parent string
+	switch {
+	case strings.HasPrefix(path, "internal/") || path == "internal":
+		// Standard library internal package.
+		return false
+	case strings.HasSuffix(path, "/internal"):
+		parent = strings.TrimSuffix(path, "/internal")
+	case strings.Contains(path, "/internal/"):
+		parent = path[:strings.LastIndex(path, "/internal/")]
+	default:
+		return true
+	}
+	return importer == parent || strings.HasPrefix(importer, parent+"/")
+}
+
+// inertExpr returns true if evaluating e has no side effects and cannot
+// panic.
+func (p *Package) inertExpr(e ast.Expr) bool {
+	switch x := e.(type) {
+	case *ast.BasicLit:
+		return true
+	case *ast.ParenExpr:
+		return p.inertExpr(x.X)
+	case *ast.Ident:
+		return x.Name != "_"
+	case *ast.SelectorExpr:
+		// Only qualified identifiers, i.e. pkg.Name.
+		id, ok := x.X.(*ast.Ident)
+		if !ok {
+			return false
+		}
+		_, ok = p.Pkg.TypesInfo.Uses[id].(*types.PkgName)
+		return ok
+	}
+	return false
+}
+
+// inertFunc returns the function called by e and its signature, if e is a
+// call to a non-generic function that can be referred to without side
+// effects.
+func (p *Package) inertFunc(e ast.Expr) (ast.Expr, *types.Signature) {
+	call, ok := e.(*ast.CallExpr)
+	if !ok || !p.inertExpr(call.Fun) {
+		return nil, nil
+	}
+	var id *ast.Ident
+	switch fun := call.Fun.(type) {
+	case *ast.Ident:
+		id = fun
+	case *ast.SelectorExpr:
+		id = fun.Sel
+	}
+	// A function value of a generic function needs instantiation.
+	if _, ok := p.Pkg.TypesInfo.Instances[id]; ok {
+		return nil, nil
+	}
+	sig, ok := p.Pkg.TypesInfo.Types[call.Fun].Type.(*types.Signature)
+	if !ok || sig.Results().Len() == 0 {
+		return nil, nil
+	}
+	return call.Fun, sig
+}
+
+// inferredSpec returns a declaration of the variables in s whose types are
+// inferred from an expression without side effects, for when their types
+// cannot be named.
+//
+// s's original values are assigned in init functions, so they must not be
+// evaluated in the declaration. The declaration either uses the value itself
+// if it is inert (e.g. `var x = otherpkg.V`) or the zero value of the called
+// function's results (e.g. `var x = busyboxZero(otherpkg.New)`).
+//
+// It returns nil if there is no such declaration. f is the file s is in, and
+// any helper function needed is added to f. If f is nil, the returned
+// declaration is incomplete and only signals that one exists.
+func (p *Package) inferredSpec(s *ast.ValueSpec, f *ast.File) *ast.ValueSpec {
+	if len(s.Values) != 1 {
+		return nil
+	}
+	value := s.Values[0]
+	if len(s.Names) == 1 && p.inertExpr(value) {
+		return &ast.ValueSpec{
+			Names:  s.Names,
+			Values: []ast.Expr{value},
+		}
+	}
+	fun, sig := p.inertFunc(value)
+	if fun == nil || sig.Results().Len() != len(s.Names) {
+		return nil
+	}
+	if f != nil {
+		return &ast.ValueSpec{
+			Names: s.Names,
+			Values: []ast.Expr{&ast.CallExpr{
+				Fun:  ast.NewIdent(p.zeroFunc(sig, f)),
+				Args: []ast.Expr{fun},
+			}},
+		}
+	}
+	return &ast.ValueSpec{Names: s.Names}
+}
+
+// checkTypeNames returns an error if any global variable with an initializer
+// has a type that cannot be named in p, and its declaration cannot infer the
+// type without evaluating the initializer.
+func (p *Package) checkTypeNames() error {
+	for _, f := range p.Pkg.Syntax {
+		for _, decl := range f.Decls {
+			d, ok := decl.(*ast.GenDecl)
+			if !ok || d.Tok != token.VAR {
+				continue
+			}
+			for _, spec := range d.Specs {
+				s := spec.(*ast.ValueSpec)
+				if s.Values == nil || s.Type != nil {
+					continue
+				}
+				for i, name := range s.Names {
+					typ := p.varType(s, i)
+					u := p.unnameableType(typ)
+					if u == nil {
+						continue
+					}
+					if len(s.Values) == len(s.Names) {
+						single := &ast.ValueSpec{Names: []*ast.Ident{name}, Values: []ast.Expr{s.Values[i]}}
+						if p.inferredSpec(single, nil) != nil {
+							continue
+						}
+					} else if p.inferredSpec(s, nil) != nil {
+						continue
+					}
+					return fmt.Errorf("%s: cannot move initializer of global variable %s into a function: its type %s refers to %s, which cannot be named in package %s; initialize %s by calling a package-level function instead (e.g. `var %s = new%s()`)",
+						p.Pkg.Fset.Position(name.Pos()), name.Name, typ, u, p.Pkg.PkgPath, name.Name, name.Name, name.Name)
+				}
+			}
+		}
+	}
+	return nil
+}
+
+// zeroFunc returns the name of a generic function in p that takes a function
+// of sig's shape and returns the zero values of its results, e.g.
+//
+//	func busyboxZero[P0, R0 any](func(P0) R0) (r0 R0) { return }
+//
+// Helpers are shared by all functions of the same shape and are added to f
+// when first needed.
+func (p *Package) zeroFunc(sig *types.Signature, f *ast.File) string {
+	shape := fmt.Sprintf("%d,%t,%d", sig.Params().Len(), sig.Variadic(), sig.Results().Len())
+	if name, ok := p.zeroFuncs[shape]; ok {
+		return name
+	}
+	name := p.newFunctionName(fmt.Sprintf("busyboxZero%d", len(p.zeroFuncs)))
+	if p.zeroFuncs == nil {
+		p.zeroFuncs = make(map[string]string)
+	}
+	p.zeroFuncs[shape] = name
+
+	var typeParams []*ast.Ident
+	funcType := &ast.FuncType{
+		Params:  &ast.FieldList{},
+		Results: &ast.FieldList{},
+	}
+	zeroType := &ast.FuncType{
+		Params:  &ast.FieldList{List: []*ast.Field{{Type: funcType}}},
+		Results: &ast.FieldList{},
+	}
+	for i := 0; i < sig.Params().Len(); i++ {
+		param := ast.NewIdent(fmt.Sprintf("P%d", i))
+		typeParams = append(typeParams, param)
+
+		var typ ast.Expr = ast.NewIdent(param.Name)
+		if sig.Variadic() && i == sig.Params().Len()-1 {
+			typ = &ast.Ellipsis{Elt: typ}
+		}
+		funcType.Params.List = append(funcType.Params.List, &ast.Field{Type: typ})
+	}
+	for i := 0; i < sig.Results().Len(); i++ {
+		result := ast.NewIdent(fmt.Sprintf("R%d", i))
+		typeParams = append(typeParams, result)
+
+		funcType.Results.List = append(funcType.Results.List, &ast.Field{Type: ast.NewIdent(result.Name)})
+		zeroType.Results.List = append(zeroType.Results.List, &ast.Field{
+			Names: []*ast.Ident{ast.NewIdent(fmt.Sprintf("r%d", i))},
+			Type:  ast.NewIdent(result.Name),
+		})
+	}
+	zeroType.TypeParams = &ast.FieldList{List: []*ast.Field{{
+		Names: typeParams,
+		Type:  ast.NewIdent("any"),
+	}}}
+
+	f.Decls = append(f.Decls, &ast.FuncDecl{
+		Name: ast.NewIdent(name),
+		Type: zeroType,
+		Body: &ast.BlockStmt{List: []ast.Stmt{&ast.ReturnStmt{}}},
+	})
+	return name
+}
@@ -7,6 +7,8 @@ package main
 
 import (
 	"errors"
+	"flag"
+	"fmt"
 	"log"
 	"os"
 	"path/filepath"
@@ -69,6 +71,140 @@ func ResolveUntilLastSymlink(p string) string {
 	return p
 }
 
+// Link types for --install.
+const (
+	linkSymlink   = "symlink"
+	linkHard      = "hard"
+	linkShellbang = "shellbang"
+)
+
+// Overwrite policies for --install.
+const (
+	overwriteFail    = "fail"
+	overwriteSkip    = "skip"
+	overwriteReplace = "replace"
+)
+
+// install implements `bb --install [flags] DIR`, which creates a link to the
+// busybox in DIR for every command.
+func install(args []string) error {
+	f := flag.NewFlagSet("bb --install", flag.ContinueOnError)
+	link := f.String("link", linkSymlink, "type of link to create: symlink, hard or shellbang")
+	absolute := f.Bool("absolute", false, "use absolute symlink targets instead of relative ones")
+	overwrite := f.String("overwrite", overwriteFail, "what to do if a file exists: fail, skip or replace")
+	target := f.String("target", "", "path of the busybox the links point to, used as is, e.g. in a staged image (default: this binary)")
+	f.Usage = func() {
+		fmt.Fprintf(f.Output(), "Usage: %s --install [flags] DIR\n", filepath.Base(os.Args[0]))
+		f.PrintDefaults()
+	}
+	if err := f.Parse(args); errors.Is(err, flag.ErrHelp) {
+		return nil
+	} else if err != nil {
+		return err
+	}
+	if f.NArg() != 1 {
+		f.Usage()
+		return fmt.Errorf("expected exactly one directory, got %d arguments", f.NArg())
+	}
+	switch *link {
+	case linkSymlink, linkHard, linkShellbang:
+	default:
+		return fmt.Errorf("unknown link type %q", *link)
+	}
+	switch *overwrite {
+	case overwriteFail, overwriteSkip, overwriteReplace:
+	default:
+		return fmt.Errorf("unknown overwrite policy %q", *overwrite)
+	}
+
+	dir, err := filepath.Abs(f.Arg(0))
+	if err != nil {
+		return err
+	}
+	// -target is the busybox's path where the links are used, which is
+	// not necessarily where they are created, e.g. when staging an image,
+	// so it is used as is.
+	bb := *target
+	if bb == "" {
+		if bb, err = os.Executable(); err != nil {
+			return fmt.Errorf("could not determine path of busybox, use -target: %v", err)
+		}
+		if bb, err = filepath.Abs(bb); err != nil {
+			return err
+		}
+	}
+	// Hard links are made on the host, so -target must be the busybox's
+	// path there.
+	if *link == linkHard && *target != "" {
+		if _, err := os.Stat(*target); err != nil {
+			return fmt.Errorf("-link=hard needs -target to exist on the host: %v", err)
+		}
+	}
+	if err := os.MkdirAll(dir, 0o755); err != nil {
+		return err
+	}
+
+	for _, name := range bbmain.ListCmds() {
+		path := filepath.Join(dir, name)
+		if _, err := os.Lstat(path); err == nil {
+			switch *overwrite {
+			case overwriteSkip:
+				continue
+			case overwriteReplace:
+				if err := os.Remove(path); err != nil {
+					return err
+				}
+			default:
+				return fmt.Errorf("%s already exists, use -overwrite=skip or -overwrite=replace", path)
+			}
+		}
+
+		switch *link {
+		case linkSymlink:
+			linkTarget := bb
+			if !*absolute && *target == "" {
+				if linkTarget, err = filepath.Rel(dir, bb); err != nil {
+					return err
+				}
+			}
+			err = os.Symlink(linkTarget, path)
+
+		case linkHard:
+			err = os.Link(bb, path)
+
+		case linkShellbang:
+			// See run for how these are interpreted. With -target,
+			// the file is used next to the busybox, not at path.
+			cmdPath := path
+			if *target != "" {
+				cmdPath = filepath.Join(filepath.Dir(*target), name)
+			}
+			err = os.WriteFile(path, []byte(fmt.Sprintf("#!%s #!%s\n", bb, cmdPath)), 0o755)
+		}
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// isBBFlag returns true if the busybox was invoked as `bb opt`, e.g.
+// `bb --install`.
+func isBBFlag(opt string) bool {
+	if len(os.Args) < 2 || os.Args[1] != opt {
+		return false
+	}
+	// When invoked as a command, e.g. `ls --install`, the argument is
+	// the command's.
+	name := filepath.Base(os.Args[0])
+	for _, cmd := range bbmain.ListCmds() {
+		if cmd == name {
+			return false
+		}
+	}
+	return true
+}
+
 func run() {
 	// For shellbang files, the os.Arg[0] for different kernels is not always
 	// consistent. In the case of most Unix, it is /bbin/bb; for Plan 9, it is the
@@ -130,5 +266,21 @@ func run() {
 func main() {
 	os.Args[0] = ResolveUntilLastSymlink(os.Args[0])
 
+	if isBBFlag("--install") {
+		if err := install(os.Args[2:]); err != nil {
+			log.SetFlags(0)
+			log.Fatalf("Failed to install: %v", err)
+		}
+		return
+	}
+	if isBBFlag("--licenses") {
+		licenses := bbmain.Licenses()
+		if licenses == "" {
+			log.SetFlags(0)
+			log.Fatalf("No license information in this busybox; build it with makebb -embed-licenses")
+		}
+		fmt.Print(licenses)
+		return
+	}
 	run()
 }
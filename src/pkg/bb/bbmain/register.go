@@ -7,10 +7,16 @@
 package bbmain
 
 import (
+	"context"
 	"errors"
+	"flag"
 	"fmt"
+	"io"
+	"log"
 	"os"
+	"runtime/debug"
 	"sort"
+	"strings"
 	// There MUST NOT be any other dependencies here.
 	//
 	// It is preferred to copy minimal code necessary into this file, as
@@ -35,6 +41,13 @@ func ListCmds() []string {
 
 type bbCmd struct {
 	init, main func()
+
+	// godebug are the command's default GODEBUG settings.
+	godebug string
+
+	// buildInfo is the command's build info as formatted by
+	// debug.BuildInfo.String.
+	buildInfo string
 }
 
 var bbCmds = map[string]bbCmd{}
@@ -52,6 +65,116 @@ func Register(name string, init, main func()) {
 	}
 }
 
+// RegisterGODEBUG registers default GODEBUG settings for the command
+// registered as name, e.g. "panicnil=1,x509sha1=1".
+//
+// A standalone Go binary has the default GODEBUG settings of its main package,
+// derived from its module's go version, godebug directives in its go.mod and
+// //go:debug directives. A busybox only has one binary, so they are set in
+// the GODEBUG environment variable before the command runs instead, followed
+// by any GODEBUG settings of the user, which take precedence.
+//
+// Settings only read by the runtime at startup cannot be changed this way.
+// Processes started by the command inherit the settings.
+func RegisterGODEBUG(name, godebug string) {
+	cmd, ok := bbCmds[name]
+	if !ok {
+		panic(fmt.Sprintf("cannot register GODEBUG settings for unregistered command %q", name))
+	}
+	cmd.godebug = godebug
+	bbCmds[name] = cmd
+}
+
+// RegisterBuildInfo registers the build info of the command registered as
+// name, as formatted by debug.BuildInfo.String, which ReadBuildInfo returns
+// while the command runs.
+func RegisterBuildInfo(name, info string) {
+	cmd, ok := bbCmds[name]
+	if !ok {
+		panic(fmt.Sprintf("cannot register build info for unregistered command %q", name))
+	}
+	cmd.buildInfo = info
+	bbCmds[name] = cmd
+}
+
+// current is the command run by Run or RunInProcess.
+var current *bbCmd
+
+// invocation counts the command invocations by Run and RunInProcess. It only
+// ever increases, also when nested invocations return.
+var invocation int
+
+// running are the invocations that have not returned: the current one and
+// those that started it with RunInProcess or Exec.
+var running = map[int]struct{}{}
+
+// InitDep is called by the init functions of dependency packages whose
+// initialization was deferred until a command using them runs. last is the
+// package's record of the invocation it was last initialized in. InitDep
+// returns true, and records the current invocation, if the package has not
+// been initialized by a running invocation.
+//
+// Like the command's own globals, deferred dependencies are initialized again
+// in every invocation, e.g. so that their flags are registered on the
+// invocation's flag.CommandLine. A nested invocation by RunInProcess or Exec
+// does not reinitialize the dependencies it shares with the commands that
+// started it, which would clobber their state: it uses them as they are. Their
+// flags are registered only on the flag.CommandLine of the invocation that
+// initialized them.
+func InitDep(last *int) bool {
+	if _, ok := running[*last]; ok {
+		return false
+	}
+	*last = invocation
+	return true
+}
+
+// ReadBuildInfo returns the build info of the running command registered with
+// RegisterBuildInfo, or the busybox's build info as returned by
+// debug.ReadBuildInfo if there is none. Rewritten commands call it instead of
+// debug.ReadBuildInfo.
+//
+// The command's build info has its own package path, main module, dependency
+// modules and version control information, and the busybox's Go version and
+// other build settings.
+func ReadBuildInfo() (*debug.BuildInfo, bool) {
+	bi, ok := debug.ReadBuildInfo()
+	if current == nil || current.buildInfo == "" {
+		return bi, ok
+	}
+	info, err := debug.ParseBuildInfo(current.buildInfo)
+	if err != nil {
+		return bi, ok
+	}
+	if ok {
+		info.GoVersion = bi.GoVersion
+		var settings []debug.BuildSetting
+		for _, s := range bi.Settings {
+			if !strings.HasPrefix(s.Key, "vcs") {
+				settings = append(settings, s)
+			}
+		}
+		info.Settings = append(settings, info.Settings...)
+	}
+	return info, true
+}
+
+// licenses are the license and notice texts registered with
+// RegisterLicenses.
+var licenses string
+
+// RegisterLicenses registers the license and notice texts of the code in the
+// busybox, which `bb --licenses` prints.
+func RegisterLicenses(text string) {
+	licenses = text
+}
+
+// Licenses returns the texts registered with RegisterLicenses, or "" if there
+// are none.
+func Licenses() string {
+	return licenses
+}
+
 // RegisterDefault registers a default init and main function.
 func RegisterDefault(init, main func()) {
 	defaultCmd = &bbCmd{
@@ -60,22 +183,489 @@ func RegisterDefault(init, main func()) {
 	}
 }
 
+func lookup(name string) (*bbCmd, error) {
+	if c, ok := bbCmds[name]; ok {
+		return &c, nil
+	} else if defaultCmd != nil {
+		return defaultCmd, nil
+	}
+	return nil, fmt.Errorf("%w: %s", ErrNotRegistered, name)
+}
+
+// setGODEBUG sets GODEBUG to c's default settings followed by the current
+// ones, and returns a function that restores GODEBUG.
+func (c *bbCmd) setGODEBUG() (restore func()) {
+	if c.godebug == "" {
+		return func() {}
+	}
+	prev, ok := os.LookupEnv("GODEBUG")
+	godebug := c.godebug
+	if prev != "" {
+		// Later settings override earlier ones.
+		godebug += "," + prev
+	}
+	os.Setenv("GODEBUG", godebug)
+	return func() {
+		if ok {
+			os.Setenv("GODEBUG", prev)
+		} else {
+			os.Unsetenv("GODEBUG")
+		}
+	}
+}
+
 // Run runs the command with the given name.
 //
 // If the command's main exits without calling os.Exit, Run will exit with exit
 // code 0.
+//
+// The command's GODEBUG settings registered with RegisterGODEBUG are applied
+// before it is initialized.
 func Run(name string) error {
-	var cmd *bbCmd
-	if c, ok := bbCmds[name]; ok {
-		cmd = &c
-	} else if defaultCmd != nil {
-		cmd = defaultCmd
-	} else {
-		return fmt.Errorf("%w: %s", ErrNotRegistered, name)
+	cmd, err := lookup(name)
+	if err != nil {
+		return err
 	}
+	cmd.setGODEBUG()
+	current = cmd
+	invocation++
+	running[invocation] = struct{}{}
 	cmd.init()
 	cmd.main()
 	os.Exit(0)
 	// Unreachable.
 	return nil
 }
+
+// exitCode is the panic value Exit uses to unwind a command running in
+// RunInProcess.
+type exitCode struct {
+	code int
+}
+
+// inProcess is true while a command runs in RunInProcess.
+var inProcess bool
+
+// exitOnError are the flag sets of the command running in RunInProcess that
+// were requested with flag.ExitOnError, but created with flag.ContinueOnError
+// so that Exit can be called instead.
+var exitOnError = map[*flag.FlagSet]struct{}{}
+
+// startupFlags is flag.CommandLine as it was before any command ran in
+// RunInProcess. Its flags were registered by packages initialized at startup,
+// and are inherited by every command's flag.CommandLine.
+var startupFlags *flag.FlagSet
+
+// newCommandLine returns a new flag.CommandLine for a command invocation.
+func newCommandLine() *flag.FlagSet {
+	f := NewFlagSet(os.Args[0], flag.ExitOnError)
+	f.SetOutput(Stderr)
+	f.Usage = func() { flag.Usage() }
+	startupFlags.VisitAll(func(fl *flag.Flag) {
+		f.Var(fl.Value, fl.Name, fl.Usage)
+	})
+	return f
+}
+
+// resetStartupFlags sets the flags in startupFlags, whose values all command
+// invocations share, to their default values, and returns a function setting
+// them back to their current values. Values that cannot be set to their
+// default, or back, keep the value they have.
+func resetStartupFlags() (restore func()) {
+	values := map[*flag.Flag]string{}
+	startupFlags.VisitAll(func(fl *flag.Flag) {
+		values[fl] = fl.Value.String()
+		if values[fl] != fl.DefValue {
+			_ = fl.Value.Set(fl.DefValue)
+		}
+	})
+	return func() {
+		for fl, v := range values {
+			if fl.Value.String() != v {
+				_ = fl.Value.Set(v)
+			}
+		}
+	}
+}
+
+// RunInProcess runs the command with the given name and returns its exit code
+// instead of exiting the process. The command's arguments are os.Args.
+//
+// The command must have been rewritten with exit interception, which replaces
+// calls to os.Exit, log.Fatal* and exiting flag parsing with calls to Exit.
+// Otherwise, the command may still exit the process.
+//
+// Exit unwinds the command's stack with a panic, so deferred functions run
+// and recover() in the command may observe it. Calls to Exit from goroutines
+// other than the one calling RunInProcess crash the process.
+//
+// RunInProcess is not safe for concurrent use, see Exec.
+//
+// Commands may be run any number of times. Every invocation runs the
+// command's init again, which reinitializes its global variables, and gets a
+// new flag.CommandLine, whose errors are reported with exit code 2 (or 0 for
+// -h) like flag.ExitOnError. Flags registered at startup, e.g. by
+// dependencies, are set to their default value for the invocation. Other
+// state of packages initialized at startup is not reset. flag.Usage, the
+// standard logger's settings, the values of flags registered at startup and
+// GODEBUG, which is set as in Run, are restored when the command returns.
+func RunInProcess(name string) (code int, err error) {
+	cmd, err := lookup(name)
+	if err != nil {
+		return 0, err
+	}
+	return run(cmd), nil
+}
+
+// run runs cmd in process and returns its exit code.
+func run(cmd *bbCmd) (code int) {
+	if startupFlags == nil {
+		startupFlags = flag.CommandLine
+	}
+	prevInProcess, prevExitOnError, prevCurrent := inProcess, exitOnError, current
+	prevCommandLine, prevUsage := flag.CommandLine, flag.Usage
+	prevLogFlags, prevLogPrefix, prevLogOutput := log.Flags(), log.Prefix(), log.Writer()
+	defer func() {
+		inProcess, exitOnError, current = prevInProcess, prevExitOnError, prevCurrent
+		flag.CommandLine, flag.Usage = prevCommandLine, prevUsage
+		log.SetFlags(prevLogFlags)
+		log.SetPrefix(prevLogPrefix)
+		log.SetOutput(prevLogOutput)
+	}()
+
+	inProcess, exitOnError, current = true, map[*flag.FlagSet]struct{}{}, cmd
+	invocation++
+	running[invocation] = struct{}{}
+	defer delete(running, invocation)
+	defer resetStartupFlags()()
+	flag.CommandLine = newCommandLine()
+	defer cmd.setGODEBUG()()
+
+	defer func() {
+		if r := recover(); r != nil {
+			e, ok := r.(exitCode)
+			if !ok {
+				panic(r)
+			}
+			code = e.code
+		}
+	}()
+	cmd.init()
+	cmd.main()
+	return 0
+}
+
+// Stdin, Stdout and Stderr are used by rewritten commands instead of os.Stdin,
+// os.Stdout and os.Stderr.
+//
+// Exec sets them to the command's standard I/O.
+var (
+	Stdin  = os.Stdin
+	Stdout = os.Stdout
+	Stderr = os.Stderr
+)
+
+// Exec runs the command with the given name in the current process with args
+// as its arguments (without the command name) and returns its exit code.
+//
+// The command must have been rewritten with stdio interception to use stdin,
+// stdout and stderr, and with exit interception to return rather than exit
+// the process. As with exec.Cmd, nil stdio is connected to the null device,
+// and stdio other than *os.File is connected with a pipe. The standard
+// logger writes to stderr while the command runs.
+//
+// A command cannot be stopped from the outside: when ctx is done, the
+// command's standard input is closed, if it is not an *os.File.
+//
+// Exec is NOT safe for concurrent use. It swaps process-wide state while the
+// command runs: os.Args, flag.CommandLine, the standard logger's output and
+// Stdin, Stdout and Stderr. Calls to Exec or RunInProcess from several
+// goroutines at once corrupt each other's state, so callers must serialize
+// them. A command may call Exec or RunInProcess itself, as the state is
+// restored when the nested command returns, which is why Exec does not lock.
+//
+// See RunInProcess for how the command is run.
+func Exec(ctx context.Context, name string, args []string, stdin io.Reader, stdout, stderr io.Writer) (int, error) {
+	cmd, err := lookup(name)
+	if err != nil {
+		return 0, err
+	}
+	if err := ctx.Err(); err != nil {
+		return 0, err
+	}
+
+	var p pipes
+	defer p.close()
+	in, err := p.input(ctx, stdin)
+	if err != nil {
+		return 0, err
+	}
+	out, err := p.output(stdout)
+	if err != nil {
+		return 0, err
+	}
+	// Like exec.Cmd, share the pipe for combined output.
+	errOut := out
+	if !sameWriter(stdout, stderr) {
+		errOut, err = p.output(stderr)
+		if err != nil {
+			return 0, err
+		}
+	}
+
+	code := func() int {
+		prevArgs, prevLogOutput := os.Args, log.Writer()
+		prevStdin, prevStdout, prevStderr := Stdin, Stdout, Stderr
+		defer func() {
+			os.Args = prevArgs
+			log.SetOutput(prevLogOutput)
+			Stdin, Stdout, Stderr = prevStdin, prevStdout, prevStderr
+		}()
+
+		os.Args = append([]string{name}, args...)
+		Stdin, Stdout, Stderr = in, out, errOut
+		log.SetOutput(Stderr)
+		return run(cmd)
+	}()
+	return code, p.wait()
+}
+
+// sameWriter returns true if a and b are the same writer. Writers that are
+// not comparable are not the same.
+func sameWriter(a, b io.Writer) (same bool) {
+	defer func() {
+		if recover() != nil {
+			same = false
+		}
+	}()
+	return a == b
+}
+
+// pipes connect the standard I/O of a command run by Exec.
+type pipes struct {
+	// closeAfter are closed when the command returns.
+	closeAfter []io.Closer
+
+	// copies receive the results of copying the command's output.
+	copies []chan error
+
+	// done is closed when the command returns.
+	done chan struct{}
+}
+
+// input returns a file for the command to read r from.
+//
+// Like with exec.Cmd, r is read by a goroutine that may still be blocked in
+// a read of r when the command returns, and may read from r once more after
+// that, until it notices that the pipe is closed.
+func (p *pipes) input(ctx context.Context, r io.Reader) (*os.File, error) {
+	if f, ok := r.(*os.File); ok {
+		return f, nil
+	}
+	if r == nil {
+		f, err := os.Open(os.DevNull)
+		if err != nil {
+			return nil, err
+		}
+		p.closeAfter = append(p.closeAfter, f)
+		return f, nil
+	}
+
+	pr, pw, err := os.Pipe()
+	if err != nil {
+		return nil, err
+	}
+	p.closeAfter = append(p.closeAfter, pr)
+	if p.done == nil {
+		p.done = make(chan struct{})
+	}
+	done := p.done
+	go func() {
+		// Errors writing mean the command stopped reading.
+		_, _ = io.Copy(pw, r)
+		pw.Close()
+	}()
+	go func() {
+		// Unblock the copy when the command is stopped or has returned.
+		select {
+		case <-ctx.Done():
+		case <-done:
+		}
+		pw.Close()
+	}()
+	return pr, nil
+}
+
+// output returns a file for the command to write w to.
+func (p *pipes) output(w io.Writer) (*os.File, error) {
+	if f, ok := w.(*os.File); ok {
+		return f, nil
+	}
+	if w == nil {
+		f, err := os.OpenFile(os.DevNull, os.O_WRONLY, 0)
+		if err != nil {
+			return nil, err
+		}
+		p.closeAfter = append(p.closeAfter, f)
+		return f, nil
+	}
+
+	pr, pw, err := os.Pipe()
+	if err != nil {
+		return nil, err
+	}
+	p.closeAfter = append(p.closeAfter, pw)
+	c := make(chan error, 1)
+	p.copies = append(p.copies, c)
+	go func() {
+		_, err := io.Copy(w, pr)
+		pr.Close()
+		c <- err
+	}()
+	return pw, nil
+}
+
+// close closes the command's ends of the pipes.
+func (p *pipes) close() {
+	if p.done != nil {
+		close(p.done)
+		p.done = nil
+	}
+	for _, c := range p.closeAfter {
+		c.Close()
+	}
+	p.closeAfter = nil
+}
+
+// wait closes the pipes and waits for the command's output to be copied.
+func (p *pipes) wait() error {
+	p.close()
+	var err error
+	for _, c := range p.copies {
+		if cerr := <-c; cerr != nil && err == nil {
+			err = cerr
+		}
+	}
+	p.copies = nil
+	return err
+}
+
+// Exit is called by rewritten commands instead of os.Exit.
+//
+// In RunInProcess, it stops the command and makes RunInProcess return code.
+// Otherwise, it calls os.Exit.
+func Exit(code int) {
+	if !inProcess {
+		os.Exit(code)
+	}
+	panic(exitCode{code})
+}
+
+// LogFatal is called by rewritten commands instead of log.Fatal.
+func LogFatal(v ...any) {
+	log.Output(2, fmt.Sprint(v...))
+	Exit(1)
+}
+
+// LogFatalf is called by rewritten commands instead of log.Fatalf.
+func LogFatalf(format string, v ...any) {
+	log.Output(2, fmt.Sprintf(format, v...))
+	Exit(1)
+}
+
+// LogFatalln is called by rewritten commands instead of log.Fatalln.
+func LogFatalln(v ...any) {
+	log.Output(2, fmt.Sprintln(v...))
+	Exit(1)
+}
+
+// LoggerFatal is called by rewritten commands instead of l.Fatal.
+func LoggerFatal(l *log.Logger, v ...any) {
+	l.Output(2, fmt.Sprint(v...))
+	Exit(1)
+}
+
+// LoggerFatalf is called by rewritten commands instead of l.Fatalf.
+func LoggerFatalf(l *log.Logger, format string, v ...any) {
+	l.Output(2, fmt.Sprintf(format, v...))
+	Exit(1)
+}
+
+// LoggerFatalln is called by rewritten commands instead of l.Fatalln.
+func LoggerFatalln(l *log.Logger, v ...any) {
+	l.Output(2, fmt.Sprintln(v...))
+	Exit(1)
+}
+
+// LoggerFatalFunc is called by rewritten commands instead of evaluating the
+// method value l.Fatal.
+func LoggerFatalFunc(l *log.Logger) func(v ...any) {
+	return func(v ...any) {
+		l.Output(2, fmt.Sprint(v...))
+		Exit(1)
+	}
+}
+
+// LoggerFatalfFunc is called by rewritten commands instead of evaluating the
+// method value l.Fatalf.
+func LoggerFatalfFunc(l *log.Logger) func(format string, v ...any) {
+	return func(format string, v ...any) {
+		l.Output(2, fmt.Sprintf(format, v...))
+		Exit(1)
+	}
+}
+
+// LoggerFatallnFunc is called by rewritten commands instead of evaluating the
+// method value l.Fatalln.
+func LoggerFatallnFunc(l *log.Logger) func(v ...any) {
+	return func(v ...any) {
+		l.Output(2, fmt.Sprintln(v...))
+		Exit(1)
+	}
+}
+
+// NewFlagSet is called by rewritten commands instead of flag.NewFlagSet.
+//
+// In RunInProcess, flag sets write to Stderr, and flag sets requested with
+// flag.ExitOnError are created with flag.ContinueOnError, and ParseFlagSet
+// calls Exit instead.
+func NewFlagSet(name string, errorHandling flag.ErrorHandling) *flag.FlagSet {
+	if !inProcess {
+		return flag.NewFlagSet(name, errorHandling)
+	}
+	if errorHandling != flag.ExitOnError {
+		f := flag.NewFlagSet(name, errorHandling)
+		f.SetOutput(Stderr)
+		return f
+	}
+	f := flag.NewFlagSet(name, flag.ContinueOnError)
+	f.SetOutput(Stderr)
+	exitOnError[f] = struct{}{}
+	return f
+}
+
+// ParseFlagSet is called by rewritten commands instead of f.Parse.
+func ParseFlagSet(f *flag.FlagSet, arguments []string) error {
+	err := f.Parse(arguments)
+	if _, ok := exitOnError[f]; ok && err != nil {
+		if err == flag.ErrHelp {
+			Exit(0)
+		}
+		Exit(2)
+	}
+	return err
+}
+
+// ParseFlagSetFunc is called by rewritten commands instead of evaluating the
+// method value f.Parse.
+func ParseFlagSetFunc(f *flag.FlagSet) func(arguments []string) error {
+	return func(arguments []string) error {
+		return ParseFlagSet(f, arguments)
+	}
+}
+
+// ParseFlags is called by rewritten commands instead of flag.Parse.
+func ParseFlags() {
+	// flag.Parse ignores the error, too.
+	_ = ParseFlagSet(flag.CommandLine, os.Args[1:])
+}
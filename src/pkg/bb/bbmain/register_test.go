@@ -0,0 +1,410 @@
+// Copyright 2024 the u-root Authors. All rights reserved
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package bbmain
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"reflect"
+	"runtime/debug"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestRunInProcess(t *testing.T) {
+	log.SetOutput(io.Discard)
+	defer log.SetOutput(os.Stderr)
+
+	for _, tt := range []struct {
+		name string
+		args []string
+		main func()
+		want int
+	}{
+		{
+			name: "return",
+			main: func() {},
+			want: 0,
+		},
+		{
+			name: "exit",
+			main: func() { Exit(3) },
+			want: 3,
+		},
+		{
+			name: "log-fatal",
+			main: func() { LogFatalf("%d", 1) },
+			want: 1,
+		},
+		{
+			name: "logger-fatal",
+			main: func() { LoggerFatal(log.New(io.Discard, "", 0), "x") },
+			want: 1,
+		},
+		{
+			name: "logger-fatal-method-value",
+			main: func() {
+				fatalf := LoggerFatalfFunc(log.New(io.Discard, "", 0))
+				fatalf("%d", 1)
+			},
+			want: 1,
+		},
+		{
+			name: "bad-flag",
+			args: []string{"-nope"},
+			main: func() {
+				flag.CommandLine.SetOutput(io.Discard)
+				ParseFlags()
+			},
+			want: 2,
+		},
+		{
+			name: "help-flag",
+			args: []string{"-h"},
+			main: func() {
+				flag.CommandLine.SetOutput(io.Discard)
+				ParseFlags()
+			},
+			want: 0,
+		},
+		{
+			name: "flag-set",
+			args: []string{"-nope"},
+			main: func() {
+				f := NewFlagSet("x", flag.ExitOnError)
+				f.SetOutput(io.Discard)
+				_ = ParseFlagSet(f, os.Args[1:])
+				Exit(5)
+			},
+			want: 2,
+		},
+		{
+			name: "flag-set-method-value",
+			args: []string{"-nope"},
+			main: func() {
+				f := NewFlagSet("x", flag.ExitOnError)
+				f.SetOutput(io.Discard)
+				parse := ParseFlagSetFunc(f)
+				_ = parse(os.Args[1:])
+				Exit(5)
+			},
+			want: 2,
+		},
+		{
+			name: "flag-set-continue",
+			args: []string{"-nope"},
+			main: func() {
+				f := NewFlagSet("x", flag.ContinueOnError)
+				f.SetOutput(io.Discard)
+				if err := ParseFlagSet(f, os.Args[1:]); err != nil {
+					Exit(5)
+				}
+			},
+			want: 5,
+		},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			bbCmds = map[string]bbCmd{}
+			defer func() { bbCmds = map[string]bbCmd{} }()
+			Register(tt.name, Noop, tt.main)
+
+			args := os.Args
+			os.Args = append([]string{tt.name}, tt.args...)
+			defer func() { os.Args = args }()
+
+			commandLine := flag.CommandLine
+			got, err := RunInProcess(tt.name)
+			if err != nil {
+				t.Fatalf("RunInProcess = %v", err)
+			}
+			if got != tt.want {
+				t.Errorf("RunInProcess = %d, want %d", got, tt.want)
+			}
+			if flag.CommandLine != commandLine {
+				t.Errorf("RunInProcess did not restore flag.CommandLine")
+			}
+			if inProcess {
+				t.Errorf("RunInProcess did not reset inProcess")
+			}
+		})
+	}
+}
+
+func TestRunInProcessNotRegistered(t *testing.T) {
+	if _, err := RunInProcess("notregistered"); !errors.Is(err, ErrNotRegistered) {
+		t.Errorf("RunInProcess = %v, want %v", err, ErrNotRegistered)
+	}
+}
+
+func TestRunInProcessPanic(t *testing.T) {
+	Register("panics", Noop, func() { panic("boom") })
+	defer delete(bbCmds, "panics")
+
+	defer func() {
+		if r := recover(); r != "boom" {
+			t.Errorf("RunInProcess recovered %v, want boom", r)
+		}
+	}()
+	_, _ = RunInProcess("panics")
+}
+
+func TestRunInProcessGODEBUG(t *testing.T) {
+	var got string
+	Register("godebug", Noop, func() { got = os.Getenv("GODEBUG") })
+	defer delete(bbCmds, "godebug")
+	RegisterGODEBUG("godebug", "panicnil=1,x509sha1=1")
+
+	for _, tt := range []struct {
+		name string
+		// GODEBUG before running the command, unset if empty
+		godebug string
+		want    string
+	}{
+		{
+			name: "unset",
+			want: "panicnil=1,x509sha1=1",
+		},
+		{
+			name:    "user",
+			godebug: "panicnil=0",
+			want:    "panicnil=1,x509sha1=1,panicnil=0",
+		},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			t.Setenv("GODEBUG", tt.godebug)
+			if tt.godebug == "" {
+				os.Unsetenv("GODEBUG")
+			}
+
+			if _, err := RunInProcess("godebug"); err != nil {
+				t.Fatalf("RunInProcess = %v", err)
+			}
+			if got != tt.want {
+				t.Errorf("GODEBUG = %q, want %q", got, tt.want)
+			}
+			if godebug, ok := os.LookupEnv("GODEBUG"); godebug != tt.godebug || ok != (tt.godebug != "") {
+				t.Errorf("GODEBUG = %q (set: %t) after RunInProcess, want %q", godebug, ok, tt.godebug)
+			}
+		})
+	}
+}
+
+func TestReadBuildInfo(t *testing.T) {
+	want := &debug.BuildInfo{
+		Path: "example.com/x/cmd/x",
+		Main: debug.Module{Path: "example.com/x", Version: "v1.2.3"},
+		Deps: []*debug.Module{
+			{Path: "example.com/y", Version: "v0.1.0", Sum: "h1:y="},
+		},
+		Settings: []debug.BuildSetting{
+			{Key: "vcs", Value: "git"},
+			{Key: "vcs.revision", Value: "0123456789abcdef"},
+		},
+	}
+	var got *debug.BuildInfo
+	Register("buildinfo", Noop, func() { got, _ = ReadBuildInfo() })
+	defer delete(bbCmds, "buildinfo")
+	RegisterBuildInfo("buildinfo", want.String())
+
+	if _, err := RunInProcess("buildinfo"); err != nil {
+		t.Fatalf("RunInProcess = %v", err)
+	}
+	if got.Path != want.Path || got.Main != want.Main || !reflect.DeepEqual(got.Deps, want.Deps) {
+		t.Errorf("ReadBuildInfo = %v, want %v", got, want)
+	}
+	// The test binary's build settings are kept, but not its VCS settings.
+	var vcs []debug.BuildSetting
+	for _, s := range got.Settings {
+		if strings.HasPrefix(s.Key, "vcs") {
+			vcs = append(vcs, s)
+		}
+	}
+	if !reflect.DeepEqual(vcs, want.Settings) {
+		t.Errorf("ReadBuildInfo VCS settings = %v, want %v", vcs, want.Settings)
+	}
+
+	if bi, _ := ReadBuildInfo(); bi != nil && bi.Path == want.Path {
+		t.Errorf("ReadBuildInfo after RunInProcess = %v, want the test binary's", bi)
+	}
+}
+
+func TestRunInProcessTwice(t *testing.T) {
+	startupFlags = flag.NewFlagSet("startup", flag.ContinueOnError)
+	defer func() { startupFlags = nil }()
+	startup := startupFlags.String("startup", "", "flag registered at startup")
+
+	var verbose *bool
+	var got []string
+	Register("twice", func() {
+		// Registering flags again must not panic.
+		verbose = flag.Bool("v", false, "verbose")
+	}, func() {
+		flag.Usage = func() {}
+		log.SetPrefix("twice: ")
+		ParseFlags()
+		got = append(got, fmt.Sprintf("%t %s %v", *verbose, *startup, flag.Args()))
+	})
+	defer delete(bbCmds, "twice")
+
+	args := os.Args
+	defer func() { os.Args = args }()
+	usage := reflect.ValueOf(flag.Usage).Pointer()
+	prefix := log.Prefix()
+
+	for _, args := range [][]string{
+		{"twice", "-v", "-startup=s", "a"},
+		{"twice", "b"},
+	} {
+		os.Args = args
+		if code, err := RunInProcess("twice"); code != 0 || err != nil {
+			t.Fatalf("RunInProcess = (%d, %v), want (0, nil)", code, err)
+		}
+	}
+
+	// Flags registered at startup are reset, too.
+	want := []string{"true s [a]", "false  [b]"}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("Invocations = %v, want %v", got, want)
+	}
+	if reflect.ValueOf(flag.Usage).Pointer() != usage {
+		t.Errorf("RunInProcess did not restore flag.Usage")
+	}
+	if log.Prefix() != prefix {
+		t.Errorf("RunInProcess did not restore log prefix, got %q", log.Prefix())
+	}
+
+	// A nested invocation restores the values of startup flags.
+	Register("nested", Noop, func() {
+		ParseFlags()
+		os.Args = []string{"twice", "c"}
+		if code, err := RunInProcess("twice"); code != 0 || err != nil {
+			t.Errorf("RunInProcess = (%d, %v), want (0, nil)", code, err)
+		}
+		got = append(got, *startup)
+	})
+	defer delete(bbCmds, "nested")
+
+	got = nil
+	os.Args = []string{"nested", "-startup=n"}
+	if code, err := RunInProcess("nested"); code != 0 || err != nil {
+		t.Fatalf("RunInProcess = (%d, %v), want (0, nil)", code, err)
+	}
+	if want := []string{"false  [c]", "n"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("Nested invocations = %v, want %v", got, want)
+	}
+	if *startup != "" {
+		t.Errorf("startup flag after RunInProcess = %q, want its value before, \"\"", *startup)
+	}
+}
+
+func TestExec(t *testing.T) {
+	Register("cat", Noop, func() {
+		log.SetFlags(0)
+		ParseFlags()
+		if _, err := io.Copy(Stdout, Stdin); err != nil {
+			LogFatal(err)
+		}
+		log.Printf("args %v", flag.Args())
+		if flag.NArg() > 0 && flag.Arg(0) == "fail" {
+			Exit(4)
+		}
+	})
+	defer delete(bbCmds, "cat")
+
+	for _, tt := range []struct {
+		name       string
+		args       []string
+		stdin      io.Reader
+		combined   bool
+		wantCode   int
+		wantStdout string
+		wantStderr string
+		// Usage lists the test binary's flags, too.
+		wantStderrPrefix string
+	}{
+		{
+			name:       "stdio",
+			args:       []string{"a"},
+			stdin:      strings.NewReader("hello"),
+			wantStdout: "hello",
+			wantStderr: "args [a]\n",
+		},
+		{
+			name:       "nil-stdin",
+			args:       []string{"fail"},
+			wantCode:   4,
+			wantStderr: "args [fail]\n",
+		},
+		{
+			name:       "combined",
+			stdin:      strings.NewReader("hello\n"),
+			combined:   true,
+			wantStdout: "hello\nargs []\n",
+		},
+		{
+			name:             "bad-flag",
+			args:             []string{"-nope"},
+			wantCode:         2,
+			wantStderrPrefix: "flag provided but not defined: -nope\nUsage of cat:\n",
+		},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			var stdout, stderr bytes.Buffer
+			var errOut io.Writer = &stderr
+			if tt.combined {
+				errOut = &stdout
+			}
+			code, err := Exec(context.Background(), "cat", tt.args, tt.stdin, &stdout, errOut)
+			if err != nil {
+				t.Fatalf("Exec = %v", err)
+			}
+			if code != tt.wantCode {
+				t.Errorf("Exec = %d, want %d", code, tt.wantCode)
+			}
+			if got := stdout.String(); got != tt.wantStdout {
+				t.Errorf("Stdout = %q, want %q", got, tt.wantStdout)
+			}
+			if got := stderr.String(); tt.wantStderrPrefix != "" {
+				if !strings.HasPrefix(got, tt.wantStderrPrefix) {
+					t.Errorf("Stderr = %q, want prefix %q", got, tt.wantStderrPrefix)
+				}
+			} else if got != tt.wantStderr {
+				t.Errorf("Stderr = %q, want %q", got, tt.wantStderr)
+			}
+			if Stdin != os.Stdin || Stdout != os.Stdout || Stderr != os.Stderr {
+				t.Errorf("Exec did not restore standard I/O")
+			}
+		})
+	}
+}
+
+func TestExecContext(t *testing.T) {
+	Register("cat", Noop, func() {
+		_, _ = io.Copy(Stdout, Stdin)
+	})
+	defer delete(bbCmds, "cat")
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	if _, err := Exec(ctx, "cat", nil, nil, nil, nil); !errors.Is(err, context.Canceled) {
+		t.Errorf("Exec = %v, want %v", err, context.Canceled)
+	}
+
+	// Standard input is closed when the context is done.
+	ctx, cancel = context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+	r, w := io.Pipe()
+	defer w.Close()
+	if code, err := Exec(ctx, "cat", nil, r, nil, nil); code != 0 || err != nil {
+		t.Errorf("Exec = (%d, %v), want (0, nil)", code, err)
+	}
+}
@@ -0,0 +1,157 @@
+// Copyright 2024 the u-root Authors. All rights reserved
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package bb
+
+import (
+	"os/exec"
+	"runtime/debug"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"golang.org/x/tools/go/packages"
+)
+
+// buildInfos records the build info of commands, as go install would embed
+// it into a binary of each command.
+type buildInfos struct {
+	// sums are the go.sum checksums of module zips, by "path version",
+	// for each go.sum file.
+	sums map[string]map[string]string
+
+	// vcs are the version control build settings of each module
+	// directory.
+	vcs map[string][]debug.BuildSetting
+}
+
+// buildInfo returns the build info of command cmd: its package path, its module
+// as main module, the modules of its dependencies and, if its module is checked
+// out in a Git repository, version control information.
+//
+// Build settings other than version control information are the same for all
+// commands and taken from the busybox at run time.
+func (b *buildInfos) buildInfo(cmd *packages.Package) (*debug.BuildInfo, error) {
+	info := &debug.BuildInfo{Path: cmd.PkgPath}
+	if cmd.Module == nil {
+		return info, nil
+	}
+
+	sums, err := b.goSum(cmd.Module.GoMod)
+	if err != nil {
+		return nil, err
+	}
+	info.Main = *debugModule(cmd.Module, sums)
+
+	mods := make(map[string]*packages.Module)
+	packages.Visit([]*packages.Package{cmd}, nil, func(p *packages.Package) {
+		if p.Module != nil && p.Module.Path != cmd.Module.Path {
+			mods[p.Module.Path] = p.Module
+		}
+	})
+	for _, m := range mods {
+		info.Deps = append(info.Deps, debugModule(m, sums))
+	}
+	sort.Slice(info.Deps, func(i, j int) bool {
+		return info.Deps[i].Path < info.Deps[j].Path
+	})
+
+	if dir := cmd.Module.Dir; dir != "" && cmd.Module.Version == "" {
+		info.Settings = b.gitSettings(dir)
+	}
+	return info, nil
+}
+
+// debugModule returns m as recorded in build info, with checksums from sums.
+func debugModule(m *packages.Module, sums map[string]string) *debug.Module {
+	dm := &debug.Module{
+		Path:    m.Path,
+		Version: m.Version,
+		Sum:     sums[m.Path+" "+m.Version],
+	}
+	if dm.Version == "" {
+		dm.Version = "(devel)"
+	}
+	if r := m.Replace; r != nil {
+		// The checksum is that of the replacement.
+		dm.Sum = ""
+		dm.Replace = debugModule(r, sums)
+	}
+	return dm
+}
+
+// goSum returns the checksums of module zips in the go.sum file belonging to
+// the go.mod file at goMod, by "path version".
+func (b *buildInfos) goSum(goMod string) (map[string]string, error) {
+	if sums, ok := b.sums[goMod]; ok {
+		return sums, nil
+	}
+	lines := make(map[string]struct{})
+	if goMod != "" {
+		if err := readGoSum(goSumFile(goMod), lines); err != nil {
+			return nil, err
+		}
+	}
+	sums := make(map[string]string)
+	for line := range lines {
+		f := strings.Fields(line)
+		// Checksums of go.mod files only are not needed.
+		if len(f) == 3 && !strings.HasSuffix(f[1], "/go.mod") {
+			sums[f[0]+" "+f[1]] = f[2]
+		}
+	}
+	if b.sums == nil {
+		b.sums = make(map[string]map[string]string)
+	}
+	b.sums[goMod] = sums
+	return sums, nil
+}
+
+// gitSettings returns the version control build settings the go command
+// records for a main module in dir, if dir is in a Git repository.
+func (b *buildInfos) gitSettings(dir string) []debug.BuildSetting {
+	if settings, ok := b.vcs[dir]; ok {
+		return settings
+	}
+	if b.vcs == nil {
+		b.vcs = make(map[string][]debug.BuildSetting)
+	}
+	b.vcs[dir] = nil
+
+	git := func(args ...string) (string, error) {
+		cmd := exec.Command("git", args...)
+		cmd.Dir = dir
+		out, err := cmd.Output()
+		return strings.TrimSpace(string(out)), err
+	}
+	status, err := git("status", "--porcelain")
+	if err != nil {
+		// Not in a Git repository, or no git.
+		return nil
+	}
+	// Like the go command, an empty repository has no revision.
+	out, err := git("-c", "log.showsignature=false", "log", "-1", "--format=%H:%ct")
+	if err != nil {
+		return nil
+	}
+	rev, ct, ok := strings.Cut(out, ":")
+	sec, err := strconv.ParseInt(ct, 10, 64)
+	if !ok || err != nil {
+		return nil
+	}
+	b.vcs[dir] = []debug.BuildSetting{
+		{Key: "vcs", Value: "git"},
+		{Key: "vcs.revision", Value: rev},
+		{Key: "vcs.time", Value: time.Unix(sec, 0).UTC().Format(time.RFC3339Nano)},
+		{Key: "vcs.modified", Value: strconv.FormatBool(status != "")},
+	}
+	return b.vcs[dir]
+}
+
+// goSumFile returns the go.sum file belonging to the go.mod file at goMod,
+// which may have been given with -modfile.
+func goSumFile(goMod string) string {
+	return strings.TrimSuffix(goMod, ".mod") + ".sum"
+}
@@ -0,0 +1,379 @@
+// Copyright 2024 the u-root Authors. All rights reserved
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package bb
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"hash"
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+
+	"golang.org/x/tools/go/packages"
+
+	"github.com/u-root/gobusybox/src/pkg/golang"
+	"github.com/u-root/uio/cp"
+)
+
+// rewriteCache is a content-addressed cache of rewritten and copied packages.
+//
+// An entry holds the files written for one package. Its key is a hash of
+// everything the written files depend on: the files of the package and of its
+// non-standard-library dependencies, whose types the rewriter uses, the
+// options it was written with, the Go version and build configuration, and
+// the executable doing the rewriting.
+//
+// Packages that are copied rather than rewritten are only keyed on their own
+// files, which are all that is written, so platforms whose build constraints
+// select the same files share them.
+//
+// Entries name the tree of written files by a hash of its contents, so
+// packages written with different keys but the same output, e.g. rewritten
+// for several platforms, share the tree, even though they are written for
+// each key.
+type rewriteCache struct {
+	dir string
+
+	// base is the hash of what is the same for all packages.
+	base string
+
+	// copyBase is the hash of what is the same for all copied packages.
+	copyBase string
+
+	// goroot tells standard library packages apart.
+	goroot string
+
+	// mu guards the fields below, as packages are written in parallel.
+	mu sync.Mutex
+
+	// pkgKeys are the hashes of packages' sources and their dependencies'
+	// by package ID.
+	pkgKeys map[string]string
+
+	// fileHashes are the hashes of source files by path.
+	fileHashes map[string]string
+
+	hits, misses int
+
+	// shared counts the misses whose output was in the cache already.
+	shared int
+}
+
+// newRewriteCache returns a cache in dir for packages built with env, whose
+// go command has the GOROOT goroot.
+func newRewriteCache(dir string, env *golang.Environ, goroot string) (*rewriteCache, error) {
+	if err := os.MkdirAll(dir, 0o755); err != nil {
+		return nil, err
+	}
+	version, err := env.Version()
+	if err != nil {
+		return nil, err
+	}
+	// Rewriting changes with the version of the rewriter.
+	exe, err := os.Executable()
+	if err != nil {
+		return nil, err
+	}
+	exeHash, err := hashFile(exe)
+	if err != nil {
+		return nil, err
+	}
+	tags := append([]string(nil), env.BuildTags...)
+	sort.Strings(tags)
+
+	h := sha256.New()
+	fmt.Fprintf(h, "exe %s\ngo %s\n", exeHash, version)
+	copyBase := hex.EncodeToString(h.Sum(nil))
+	fmt.Fprintf(h, "os %s\narch %s\ncgo %t\ntags %s\n", env.GOOS, env.GOARCH, env.CgoEnabled, strings.Join(tags, ","))
+	return &rewriteCache{
+		dir:        dir,
+		base:       hex.EncodeToString(h.Sum(nil)),
+		copyBase:   copyBase,
+		goroot:     goroot,
+		pkgKeys:    make(map[string]string),
+		fileHashes: make(map[string]string),
+	}, nil
+}
+
+// write writes the files of package p into destDir with write, or copies
+// them from the cache. options are everything besides p's sources that write
+// depends on.
+//
+// write is called with an empty directory, whose contents are added to the
+// cache.
+//
+// A nil cache always calls write with destDir.
+func (c *rewriteCache) write(p *packages.Package, destDir string, options []string, write func(dir string) error) error {
+	if c == nil {
+		return write(destDir)
+	}
+	c.mu.Lock()
+	pkgKey, err := c.pkgKey(p)
+	c.mu.Unlock()
+	if err != nil {
+		return err
+	}
+	h := sha256.New()
+	fmt.Fprintf(h, "base %s\npkg %s\n", c.base, pkgKey)
+	for _, o := range options {
+		fmt.Fprintf(h, "option %q\n", o)
+	}
+	return c.writeEntry(hex.EncodeToString(h.Sum(nil)), destDir, write)
+}
+
+// copy is like write for packages that write copies of their own files, i.e.
+// their GoFiles, OtherFiles and EmbedFiles, which are all that their entry
+// is keyed on besides options.
+func (c *rewriteCache) copy(p *packages.Package, destDir string, options []string, write func(dir string) error) error {
+	if c == nil {
+		return write(destDir)
+	}
+	h := sha256.New()
+	fmt.Fprintf(h, "copy %s\n", c.copyBase)
+	for _, o := range options {
+		fmt.Fprintf(h, "option %q\n", o)
+	}
+	c.mu.Lock()
+	err := c.hashPkg(h, p, p.GoFiles, p.OtherFiles, p.EmbedFiles)
+	c.mu.Unlock()
+	if err != nil {
+		return err
+	}
+	return c.writeEntry(hex.EncodeToString(h.Sum(nil)), destDir, write)
+}
+
+// writeEntry copies the tree of the cache entry key into destDir, after
+// adding it with write if it does not exist.
+func (c *rewriteCache) writeEntry(key, destDir string, write func(dir string) error) error {
+	entry := filepath.Join(c.dir, "keys", key[:2], key)
+
+	if data, err := os.ReadFile(entry); err == nil {
+		// Incomplete entries and removed trees are added again.
+		if sum := string(data); len(sum) == 2*sha256.Size && exists(c.tree(sum)) {
+			c.count(true, false)
+			return cp.CopyTree(c.tree(sum), destDir)
+		}
+	} else if !os.IsNotExist(err) {
+		return err
+	}
+
+	tmp, err := os.MkdirTemp(c.dir, "tmp-")
+	if err != nil {
+		return err
+	}
+	defer os.RemoveAll(tmp)
+	if err := os.Chmod(tmp, 0o755); err != nil {
+		return err
+	}
+	if err := write(tmp); err != nil {
+		return err
+	}
+	sum, err := hashTree(tmp)
+	if err != nil {
+		return err
+	}
+	tree := c.tree(sum)
+	c.count(false, exists(tree))
+	if err := os.MkdirAll(filepath.Dir(tree), 0o755); err != nil {
+		return err
+	}
+	// The tree may be in the cache already, or another build may have
+	// added it in the meantime, with the same contents.
+	if err := os.Rename(tmp, tree); err != nil && !exists(tree) {
+		return err
+	}
+
+	if err := os.MkdirAll(filepath.Dir(entry), 0o755); err != nil {
+		return err
+	}
+	f, err := os.CreateTemp(c.dir, "tmp-")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(f.Name())
+	if _, err := f.WriteString(sum); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Close(); err != nil {
+		return err
+	}
+	if err := os.Rename(f.Name(), entry); err != nil {
+		return err
+	}
+	return cp.CopyTree(tree, destDir)
+}
+
+// tree returns the directory of the tree of written files whose hashTree is
+// sum.
+func (c *rewriteCache) tree(sum string) string {
+	return filepath.Join(c.dir, "trees", sum[:2], sum)
+}
+
+// count counts a cache hit or miss, and whether a miss's output was in the
+// cache already.
+func (c *rewriteCache) count(hit, shared bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if hit {
+		c.hits++
+	} else {
+		c.misses++
+	}
+	if shared {
+		c.shared++
+	}
+}
+
+// pkgKey returns a hash of p's sources and those of its non-standard-library
+// dependencies. c.mu must be held.
+func (c *rewriteCache) pkgKey(p *packages.Package) (string, error) {
+	if key, ok := c.pkgKeys[p.ID]; ok {
+		return key, nil
+	}
+
+	h := sha256.New()
+	if err := c.hashPkg(h, p, p.CompiledGoFiles, p.OtherFiles, p.EmbedFiles); err != nil {
+		return "", err
+	}
+
+	paths := make([]string, 0, len(p.Imports))
+	for path := range p.Imports {
+		paths = append(paths, path)
+	}
+	sort.Strings(paths)
+	for _, path := range paths {
+		imp := p.Imports[path]
+		// Standard library packages are covered by the Go version.
+		if isStdlib(imp, c.goroot) {
+			fmt.Fprintf(h, "import %s std\n", path)
+			continue
+		}
+		key, err := c.pkgKey(imp)
+		if err != nil {
+			return "", err
+		}
+		fmt.Fprintf(h, "import %s %s\n", path, key)
+	}
+
+	key := hex.EncodeToString(h.Sum(nil))
+	c.pkgKeys[p.ID] = key
+	return key, nil
+}
+
+// hashPkg adds p's identity, module and the given source files to h. c.mu
+// must be held.
+func (c *rewriteCache) hashPkg(h hash.Hash, p *packages.Package, files ...[]string) error {
+	fmt.Fprintf(h, "pkg %s %s %s\n", p.ID, p.PkgPath, p.Name)
+	if m := p.Module; m != nil {
+		fmt.Fprintf(h, "module %s %s %s\n", m.Path, m.Version, m.GoVersion)
+		if r := m.Replace; r != nil {
+			fmt.Fprintf(h, "replace %s %s %s\n", r.Path, r.Version, r.GoVersion)
+		}
+	}
+	for _, fs := range files {
+		fmt.Fprintf(h, "files %d\n", len(fs))
+		for _, f := range fs {
+			if err := c.hashSource(h, f); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// hashSource adds the path and contents of source file f to h.
+func (c *rewriteCache) hashSource(h hash.Hash, f string) error {
+	fh, ok := c.fileHashes[f]
+	if !ok {
+		var err error
+		if fh, err = hashFile(f); err != nil {
+			return err
+		}
+		c.fileHashes[f] = fh
+	}
+	fmt.Fprintf(h, "file %s %s\n", f, fh)
+	return nil
+}
+
+// hashTree returns a hex-encoded SHA-256 hash of the names, modes and contents
+// of the files and directories in dir.
+func hashTree(dir string) (string, error) {
+	h := sha256.New()
+	err := filepath.WalkDir(dir, func(path string, d fs.DirEntry, err error) error {
+		if err != nil || path == dir {
+			return err
+		}
+		rel, err := filepath.Rel(dir, path)
+		if err != nil {
+			return err
+		}
+		info, err := d.Info()
+		if err != nil {
+			return err
+		}
+		if d.IsDir() {
+			fmt.Fprintf(h, "dir %q %o\n", filepath.ToSlash(rel), info.Mode())
+			return nil
+		}
+		fh, err := hashFile(path)
+		if err != nil {
+			return err
+		}
+		fmt.Fprintf(h, "file %q %o %s\n", filepath.ToSlash(rel), info.Mode(), fh)
+		return nil
+	})
+	if err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(h.Sum(nil)), nil
+}
+
+// hashFile returns the hex-encoded SHA-256 hash of the file at path.
+func hashFile(path string) (string, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+	h := sha256.New()
+	if _, err := io.Copy(h, f); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(h.Sum(nil)), nil
+}
+
+func exists(path string) bool {
+	_, err := os.Stat(path)
+	return err == nil
+}
+
+// clearGenSrcDir removes the busybox source generated into dir by a previous
+// build, so that it can be generated there again.
+//
+// It refuses to remove anything from directories other than previous
+// GenSrcDirs.
+func clearGenSrcDir(dir string) error {
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return err
+	}
+	for _, e := range entries {
+		if e.Name() != "src" {
+			return fmt.Errorf("directory supplied for busybox generated source contains %s, so it is not a previously generated directory", e.Name())
+		}
+	}
+	src := filepath.Join(dir, "src")
+	if !exists(filepath.Join(src, "bb.u-root.com/bb")) {
+		return fmt.Errorf("directory supplied for busybox generated source does not contain a previously generated busybox")
+	}
+	return os.RemoveAll(src)
+}
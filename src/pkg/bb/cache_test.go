@@ -0,0 +1,115 @@
+// Copyright 2024 the u-root Authors. All rights reserved
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package bb
+
+import (
+	"os"
+	"path/filepath"
+	"runtime"
+	"testing"
+
+	"golang.org/x/tools/go/packages"
+
+	"github.com/u-root/gobusybox/src/pkg/golang"
+)
+
+func TestCacheKey(t *testing.T) {
+	dir := t.TempDir()
+	depFile := filepath.Join(dir, "dep.go")
+	cmdFile := filepath.Join(dir, "cmd.go")
+	dep := &packages.Package{ID: "example.com/dep", PkgPath: "example.com/dep", CompiledGoFiles: []string{depFile}}
+	cmd := &packages.Package{
+		ID:              "example.com/cmd",
+		PkgPath:         "example.com/cmd",
+		CompiledGoFiles: []string{cmdFile},
+		Imports: map[string]*packages.Package{
+			"example.com/dep": dep,
+			"fmt":             {ID: "fmt", PkgPath: "fmt"},
+		},
+	}
+	key := func(depSource string) string {
+		t.Helper()
+		if err := os.WriteFile(depFile, []byte(depSource), 0o644); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(cmdFile, []byte("package main"), 0o644); err != nil {
+			t.Fatal(err)
+		}
+		c, err := newRewriteCache(filepath.Join(dir, "cache"), golang.Default(), runtime.GOROOT())
+		if err != nil {
+			t.Fatal(err)
+		}
+		k, err := c.pkgKey(cmd)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return k
+	}
+
+	a := key("package dep\n\nfunc F() int { return 0 }")
+	if b := key("package dep\n\nfunc F() int { return 0 }"); a != b {
+		t.Errorf("key changed without changes to sources")
+	}
+	// The command's rewrite depends on its dependencies' types.
+	if b := key("package dep\n\nfunc F() string { return \"\" }"); a == b {
+		t.Errorf("key did not change with a dependency's source")
+	}
+}
+
+func TestCacheTargets(t *testing.T) {
+	dir := t.TempDir()
+	file := func(name string) string {
+		path := filepath.Join(dir, name)
+		if err := os.WriteFile(path, []byte("package p\n"), 0o644); err != nil {
+			t.Fatal(err)
+		}
+		return path
+	}
+	p := &packages.Package{ID: "example.com/p", PkgPath: "example.com/p", Name: "p", GoFiles: []string{file("p.go")}}
+	p.CompiledGoFiles = p.GoFiles
+
+	cache := func(goarch string) *rewriteCache {
+		t.Helper()
+		c, err := newRewriteCache(filepath.Join(dir, "cache"), golang.Default(golang.WithGOOS("linux"), golang.WithGOARCH(goarch)), runtime.GOROOT())
+		if err != nil {
+			t.Fatal(err)
+		}
+		return c
+	}
+	write := func(dir string) error {
+		return os.WriteFile(filepath.Join(dir, "p.go"), []byte("package p\n"), 0o644)
+	}
+	amd64, riscv64 := cache("amd64"), cache("riscv64")
+	for _, c := range []*rewriteCache{amd64, riscv64} {
+		if err := c.write(p, t.TempDir(), nil, write); err != nil {
+			t.Fatal(err)
+		}
+		if err := c.copy(p, t.TempDir(), nil, write); err != nil {
+			t.Fatal(err)
+		}
+	}
+	// Rewritten packages depend on the platform through their
+	// dependencies' types, copies only on their files.
+	if amd64.hits != 0 || riscv64.hits != 1 {
+		t.Errorf("cache hits = %d for linux/amd64 and %d for linux/riscv64, want 0 and 1 for the copy", amd64.hits, riscv64.hits)
+	}
+	// All entries have the same files, which are kept once: the rewrite
+	// for linux/riscv64 shares those written for linux/amd64.
+	if amd64.shared != 1 || riscv64.shared != 1 {
+		t.Errorf("cache shared = %d for linux/amd64 and %d for linux/riscv64, want 1 for the second write of each", amd64.shared, riscv64.shared)
+	}
+	if trees, err := filepath.Glob(filepath.Join(dir, "cache", "trees", "*", "*")); err != nil || len(trees) != 1 {
+		t.Errorf("cache trees = %v, %v, want 1", trees, err)
+	}
+
+	// Other files are copied anew.
+	p.GoFiles = []string{file("p_riscv64.go")}
+	if err := riscv64.copy(p, t.TempDir(), nil, write); err != nil {
+		t.Fatal(err)
+	}
+	if riscv64.hits != 1 {
+		t.Errorf("copy of other files was taken from the cache")
+	}
+}
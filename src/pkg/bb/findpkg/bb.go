@@ -15,6 +15,7 @@ import (
 	"os"
 	"path"
 	"path/filepath"
+	"regexp"
 	"sort"
 	"strings"
 
@@ -38,23 +39,10 @@ func addPkg(plist []*packages.Package, p *packages.Package) ([]*packages.Package
 	return plist, nil
 }
 
-func newPackages(l ulog.Logger, genv *golang.Environ, env Env, patterns ...string) ([]*packages.Package, error) {
-	// Two steps:
-	//
-	// 1. Resolve globs, filter packages with build constraints.
-	//    Produce an explicit list of packages.
-	//
-	// 2. Look up every piece of information necessary from those packages.
-	//    (Includes optimizations to reduce the amount of time it takes to
-	//    do type-checking, etc.)
-
-	// Step 1.
-	paths, err := ResolveGlobs(l, genv, env, patterns)
-	if err != nil {
-		return nil, err
-	}
-
-	// Step 2.
+// newPackages looks up every piece of information necessary about the
+// packages at paths, resolved by ResolveGlobs. (Includes optimizations to
+// reduce the amount of time it takes to do type-checking, etc.)
+func newPackages(genv *golang.Environ, paths ...string) ([]*packages.Package, error) {
 	importPkgs, err := loadPkgs(genv, paths...)
 	if err != nil {
 		return nil, fmt.Errorf("failed to load package %v: %v", paths, err)
@@ -121,22 +109,231 @@ func newPackages(l ulog.Logger, genv *golang.Environ, env Env, patterns ...strin
 //   - GBB_PATH=$HOME/u-root:$HOME/yourproject cmds/core/* cmd/foobar
 //
 //   - UROOT_SOURCE=$HOME/u-root github.com/u-root/u-root/cmds/core/ip
+//
+// Commands are named after the last element of their package path, skipping
+// a major version suffix, e.g. github.com/x/y/cmd/foo/v2 is named foo. A name
+// may be given explicitly as name=pattern, where pattern must match exactly
+// one package, e.g. yserver=github.com/x/y/cmd/server.
+//
+// Commands in GOPATH directories outside of Go modules may be mixed with
+// commands in modules: directories in the src directory of a GOPATH entry of
+// genv that have no go.mod file in them or above them are looked up with
+// GO111MODULE=off, the rest with genv. Only directories, not Go package paths,
+// are recognized this way, so GOPATH commands must also be excluded by
+// directory.
+//
+// The default GODEBUG settings of each command are looked up as well.
 func NewPackages(l ulog.Logger, genv *golang.Environ, env Env, names ...string) ([]*bbinternal.Package, error) {
+	groups, err := NewPackageGroups(l, genv, env, names)
+	if err != nil {
+		return nil, err
+	}
+	return groups[0], nil
+}
+
+// NewPackageGroups collects package metadata about the packages named by each
+// group of names, as NewPackages does for one group.
+//
+// Packages are looked up once for all groups, and a package named in several
+// groups is the same *bbinternal.Package in each of them. It also has the
+// same command name in each: naming it differently with name=pattern is an
+// error.
+func NewPackageGroups(l ulog.Logger, genv *golang.Environ, env Env, groups ...[]string) ([][]*bbinternal.Package, error) {
 	if genv == nil {
 		return nil, fmt.Errorf("Go build environment must be specified")
 	}
-	ps, err := newPackages(l, genv, env, names...)
+	names := make([][]string, len(groups))
+	gopathNames := make([][]string, len(groups))
+	for i, group := range groups {
+		names[i], gopathNames[i] = splitGOPATH(genv, env, group)
+	}
+
+	ips := make([][]*bbinternal.Package, len(groups))
+	for _, lookup := range []struct {
+		genv   *golang.Environ
+		groups [][]string
+	}{
+		{genv, names},
+		// GOFLAGS such as -modfile are meant for modules.
+		{genv.Copy(golang.WithGO111MODULE("off"), golang.WithoutModuleGOFLAGS()), gopathNames},
+	} {
+		ps, err := newCommands(l, lookup.genv, env, lookup.groups)
+		if err != nil {
+			return nil, err
+		}
+		for i := range ips {
+			ips[i] = append(ips[i], ps[i]...)
+		}
+	}
+	return ips, nil
+}
+
+// splitGOPATH splits names into those to be looked up with genv and those of
+// GOPATH packages outside any Go module, which must be looked up with
+// GO111MODULE=off to be found while genv uses modules.
+//
+// Only names that are directories are recognized as GOPATH packages, e.g.
+// $GOPATH/src/legacy/cmd/foo or legacy/cmd/* relative to GBB_PATH. A glob or
+// exclusion is a GOPATH name if all the directories it matches are.
+func splitGOPATH(genv *golang.Environ, env Env, names []string) (other, gopath []string) {
+	if genv.GO111MODULE == "off" {
+		return names, nil
+	}
+	for _, name := range names {
+		_, pattern := splitName(strings.TrimPrefix(name, "-"))
+		isPath, dirs := env.Glob(ulog.Null, pattern)
+		inGOPATH := isPath && len(dirs) > 0
+		for _, dir := range dirs {
+			inGOPATH = inGOPATH && isGOPATHDir(genv, dir)
+		}
+		if inGOPATH {
+			gopath = append(gopath, name)
+		} else {
+			other = append(other, name)
+		}
+	}
+	return other, gopath
+}
+
+// isGOPATHDir returns true if dir is in the src directory of one of genv's
+// GOPATH directories and not in a Go module.
+func isGOPATHDir(genv *golang.Environ, dir string) bool {
+	for _, gopath := range filepath.SplitList(genv.GOPATH) {
+		rel, err := filepath.Rel(filepath.Join(gopath, "src"), dir)
+		if err == nil && rel != ".." && !strings.HasPrefix(rel, ".."+string(filepath.Separator)) {
+			_, noModule := Modules([]string{dir})
+			return len(noModule) > 0
+		}
+	}
+	return false
+}
+
+// newCommands returns the commands named by each group of names, looked up
+// with genv.
+func newCommands(l ulog.Logger, genv *golang.Environ, env Env, groups [][]string) ([][]*bbinternal.Package, error) {
+	// Step 1: resolve globs and names of each group, and filter packages
+	// with build constraints.
+	cmdNames := make([]map[string]string, len(groups))
+	groupPaths := make([]map[string]struct{}, len(groups))
+	var paths []string
+	for i, names := range groups {
+		groupPaths[i] = make(map[string]struct{})
+		if include, _ := splitExclusions(names); len(include) == 0 {
+			continue
+		}
+		patterns, named, err := explicitNames(l, genv, env, names)
+		if err != nil {
+			return nil, err
+		}
+		cmdNames[i] = named
+		resolved, err := ResolveGlobs(l, genv, env, patterns)
+		if err != nil {
+			return nil, err
+		}
+		for _, path := range resolved {
+			if _, ok := groupPaths[i][path]; ok {
+				continue
+			}
+			groupPaths[i][path] = struct{}{}
+			paths = append(paths, path)
+		}
+	}
+	ips := make([][]*bbinternal.Package, len(groups))
+	if len(paths) == 0 {
+		return ips, nil
+	}
+
+	// Step 2: look up all packages of all groups at once.
+	ps, err := newPackages(genv, paths...)
 	if err != nil {
 		return nil, err
 	}
 
-	var ips []*bbinternal.Package
+	var pkgPaths []string
 	for _, p := range ps {
-		ips = append(ips, bbinternal.NewPackage(path.Base(p.PkgPath), p))
+		pkgPaths = append(pkgPaths, p.PkgPath)
+	}
+	godebug, err := genv.DefaultGODEBUG(pkgPaths...)
+	if err != nil {
+		return nil, fmt.Errorf("failed to look up default GODEBUG settings: %v", err)
+	}
+
+	for _, p := range ps {
+		var ip *bbinternal.Package
+		for i := range groups {
+			if _, ok := groupPaths[i][p.PkgPath]; !ok {
+				continue
+			}
+			name, ok := cmdNames[i][p.PkgPath]
+			if !ok {
+				name = CommandName(p.PkgPath)
+			}
+			if ip == nil {
+				ip = bbinternal.NewPackage(name, p)
+				ip.GODEBUG = godebug[p.PkgPath]
+			} else if ip.Name != name {
+				return nil, fmt.Errorf("package %s is named both %s and %s", p.PkgPath, ip.Name, name)
+			}
+			ips[i] = append(ips[i], ip)
+		}
 	}
 	return ips, nil
 }
 
+// majorVersion matches major version suffixes of Go module paths.
+var majorVersion = regexp.MustCompile(`^v([2-9]|[1-9][0-9]+)$`)
+
+// CommandName returns the default command name for the package at pkgPath:
+// its last element, or the one before if the last is a major version suffix.
+func CommandName(pkgPath string) string {
+	name := path.Base(pkgPath)
+	if dir := path.Dir(pkgPath); majorVersion.MatchString(name) && dir != "." {
+		return path.Base(dir)
+	}
+	return name
+}
+
+// splitName splits a name=pattern argument. name is empty if pattern has no
+// explicit name.
+func splitName(arg string) (name string, pattern string) {
+	// Exclusions cannot be named, and names cannot contain slashes.
+	if strings.HasPrefix(arg, "-") {
+		return "", arg
+	}
+	name, pattern, ok := strings.Cut(arg, "=")
+	if !ok || name == "" || strings.ContainsRune(name, '/') {
+		return "", arg
+	}
+	return name, pattern
+}
+
+// explicitNames resolves the packages of name=pattern arguments. It returns
+// the arguments with names removed, and a map of package path to name.
+func explicitNames(l ulog.Logger, genv *golang.Environ, env Env, args []string) ([]string, map[string]string, error) {
+	patterns := make([]string, 0, len(args))
+	cmdNames := make(map[string]string)
+	for _, arg := range args {
+		name, pattern := splitName(arg)
+		if name == "" {
+			patterns = append(patterns, arg)
+			continue
+		}
+		paths, err := ResolveGlobs(l, genv, env, []string{pattern})
+		if err != nil {
+			return nil, nil, fmt.Errorf("failed to resolve command %s: %w", arg, err)
+		}
+		if len(paths) != 1 {
+			return nil, nil, fmt.Errorf("command name %s must be given for exactly one package, but %s matches %d packages", name, pattern, len(paths))
+		}
+		if other, ok := cmdNames[paths[0]]; ok && other != name {
+			return nil, nil, fmt.Errorf("package %s is named both %s and %s", paths[0], other, name)
+		}
+		cmdNames[paths[0]] = name
+		patterns = append(patterns, paths[0])
+	}
+	return patterns, cmdNames, nil
+}
+
 func loadPkgs(env *golang.Environ, patterns ...string) ([]*packages.Package, error) {
 	mode := packages.NeedName | packages.NeedImports | packages.NeedFiles | packages.NeedDeps | packages.NeedTypes | packages.NeedSyntax | packages.NeedTypesInfo | packages.NeedCompiledGoFiles | packages.NeedModule | packages.NeedEmbedFiles
 	return env.Lookup(mode, patterns...)
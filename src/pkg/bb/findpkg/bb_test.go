@@ -503,3 +503,92 @@ func TestModules(t *testing.T) {
 		t.Errorf("GlobPaths = %v, want %v", got, wantG)
 	}
 }
+
+func TestCommandName(t *testing.T) {
+	for _, tt := range []struct {
+		pkgPath string
+		want    string
+	}{
+		{"github.com/u-root/u-root/cmds/core/ls", "ls"},
+		{"github.com/x/y/cmd/foo/v2", "foo"},
+		{"github.com/x/y/v12", "y"},
+		{"github.com/x/y/cmd/v1", "v1"},
+		{"github.com/x/y/cmd/v0", "v0"},
+		{"github.com/x/y/cmd/v2beta", "v2beta"},
+		{"v2", "v2"},
+	} {
+		if got := CommandName(tt.pkgPath); got != tt.want {
+			t.Errorf("CommandName(%s) = %s, want %s", tt.pkgPath, got, tt.want)
+		}
+	}
+}
+
+func TestSplitName(t *testing.T) {
+	for _, tt := range []struct {
+		arg         string
+		wantName    string
+		wantPattern string
+	}{
+		{"./cmd/server", "", "./cmd/server"},
+		{"srv=./cmd/server", "srv", "./cmd/server"},
+		{"srv=github.com/x/y/cmd/server", "srv", "github.com/x/y/cmd/server"},
+		{"-srv=./cmd/server", "", "-srv=./cmd/server"},
+		{"=./cmd/server", "", "=./cmd/server"},
+		{"./a=b/cmd", "", "./a=b/cmd"},
+	} {
+		name, pattern := splitName(tt.arg)
+		if name != tt.wantName || pattern != tt.wantPattern {
+			t.Errorf("splitName(%s) = (%q, %q), want (%q, %q)", tt.arg, name, pattern, tt.wantName, tt.wantPattern)
+		}
+	}
+}
+
+func TestSplitGOPATH(t *testing.T) {
+	dir := t.TempDir()
+	gopath := filepath.Join(dir, "gopath")
+	for _, d := range []string{"src/legacy/cmd/foo", "src/legacy/cmd/bar", "src/modular/cmd/baz", "elsewhere/cmd/qux"} {
+		_ = os.MkdirAll(filepath.Join(gopath, d), 0755)
+	}
+	_ = os.WriteFile(filepath.Join(gopath, "src/modular/go.mod"), nil, 0644)
+
+	env := Env{GBBPath: []string{filepath.Join(gopath, "src")}}
+	names := []string{
+		"legacy/cmd/*",
+		"-" + filepath.Join(gopath, "src/legacy/cmd/bar"),
+		"f=" + filepath.Join(gopath, "src/legacy/cmd/foo"),
+		"modular/cmd/baz",
+		filepath.Join(gopath, "elsewhere/cmd/qux"),
+		"github.com/u-root/u-root/cmds/core/ls",
+	}
+
+	for _, tt := range []struct {
+		name       string
+		genv       *golang.Environ
+		wantOther  []string
+		wantGOPATH []string
+	}{
+		{
+			name:       "modules",
+			genv:       golang.Default(golang.WithGOPATH(gopath), golang.WithGO111MODULE("on")),
+			wantOther:  names[3:],
+			wantGOPATH: names[:3],
+		},
+		{
+			name:      "GO111MODULE=off",
+			genv:      golang.Default(golang.WithGOPATH(gopath), golang.WithGO111MODULE("off")),
+			wantOther: names,
+		},
+		{
+			name:      "other-GOPATH",
+			genv:      golang.Default(golang.WithGOPATH(filepath.Join(dir, "other")), golang.WithGO111MODULE("on")),
+			wantOther: names,
+		},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			other, gopath := splitGOPATH(tt.genv, env, names)
+			if !reflect.DeepEqual(other, tt.wantOther) || !reflect.DeepEqual(gopath, tt.wantGOPATH) {
+				t.Errorf("splitGOPATH = %v, %v, want %v, %v", other, gopath, tt.wantOther, tt.wantGOPATH)
+			}
+		})
+	}
+}
@@ -0,0 +1,194 @@
+// Copyright 2024 the u-root Authors. All rights reserved
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package bb
+
+import (
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+)
+
+// licenseFiles returns the paths of license files in the module directory
+// dir, sorted, i.e. files named LICENSE, LICENCE or COPYING with any
+// extension or suffix, such as LICENSE.md or LICENSE-APACHE, other than Go
+// source files.
+func licenseFiles(dir string) ([]string, error) {
+	return filesWithPrefix(dir, "LICENSE", "LICENCE", "COPYING")
+}
+
+// noticeFiles returns the paths of license files and NOTICE files in the
+// module directory dir, sorted, as licenseFiles does.
+func noticeFiles(dir string) ([]string, error) {
+	return filesWithPrefix(dir, "LICENSE", "LICENCE", "COPYING", "NOTICE")
+}
+
+// filesWithPrefix returns the paths of files in dir whose upper-cased name
+// starts with one of prefixes, other than Go source files, sorted.
+func filesWithPrefix(dir string, prefixes ...string) ([]string, error) {
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return nil, err
+	}
+	var files []string
+	for _, e := range entries {
+		if e.IsDir() || strings.HasSuffix(e.Name(), ".go") {
+			continue
+		}
+		name := strings.ToUpper(e.Name())
+		for _, prefix := range prefixes {
+			if strings.HasPrefix(name, prefix) {
+				files = append(files, filepath.Join(dir, e.Name()))
+				break
+			}
+		}
+	}
+	sort.Strings(files)
+	return files, nil
+}
+
+// licenses are SPDX license identifiers and phrases that identify their
+// license texts, after lowercasing and collapsing white space. The first
+// match wins, so licenses whose texts mention others come first.
+//
+// GNU licenses mention each other, so their titles must be at the top. Their
+// identifiers get an -only or -or-later suffix, see gnuSuffix.
+var licenses = []struct {
+	id      string
+	title   bool
+	phrases []string
+}{
+	{"AGPL-3.0", true, []string{"gnu affero general public license version 3"}},
+	{"LGPL-3.0", true, []string{"gnu lesser general public license version 3"}},
+	{"LGPL-2.1", true, []string{"gnu lesser general public license version 2.1"}},
+	{"LGPL-2.0", true, []string{"gnu library general public license version 2"}},
+	{"GPL-3.0", true, []string{"gnu general public license version 3"}},
+	{"GPL-2.0", true, []string{"gnu general public license version 2"}},
+	{"MPL-2.0", false, []string{"mozilla public license", "version 2.0"}},
+	{"EPL-2.0", false, []string{"eclipse public license - v 2.0"}},
+	{"Apache-2.0", false, []string{"apache license", "version 2.0"}},
+	{"BSL-1.0", false, []string{"boost software license - version 1.0"}},
+	{"CC0-1.0", false, []string{"cc0 1.0 universal"}},
+	{"Unlicense", false, []string{"this is free and unencumbered software released into the public domain"}},
+	{"ISC", false, []string{"permission to use, copy, modify, and/or distribute this software for any purpose with or without fee is hereby granted"}},
+	{"MIT", false, []string{"permission is hereby granted, free of charge, to any person obtaining a copy"}},
+	{"BSD-3-Clause", false, []string{"redistribution and use in source and binary forms", "neither the name"}},
+	{"BSD-2-Clause", false, []string{"redistribution and use in source and binary forms"}},
+}
+
+// titleLen is how far into a license text its title is looked for.
+const titleLen = 1000
+
+// detectLicense returns the SPDX identifier of the license text, or "" if it
+// is not recognized.
+//
+// This is a heuristic, not a full license classifier: it only tells common
+// licenses apart and does not check that the text is unmodified.
+func detectLicense(text string) string {
+	text = strings.Join(strings.Fields(strings.ToLower(text)), " ")
+	head := text
+	if len(head) > titleLen {
+		head = head[:titleLen]
+	}
+	for _, l := range licenses {
+		t := text
+		if l.title {
+			t = head
+		}
+		found := true
+		for _, p := range l.phrases {
+			if !strings.Contains(t, p) {
+				found = false
+				break
+			}
+		}
+		if found {
+			if l.title {
+				return l.id + gnuSuffix(text)
+			}
+			return l.id
+		}
+	}
+	return ""
+}
+
+// gnuSuffix returns the suffix of the SPDX identifier of the GNU license
+// text: -or-later if it grants the option to use any later version of the
+// license, -only otherwise.
+//
+// The licenses' own "How to Apply These Terms" appendix suggests that
+// option, so only the text before it counts, e.g. a preamble added by the
+// program's authors.
+func gnuSuffix(text string) string {
+	if i := strings.Index(text, "how to apply these terms"); i >= 0 {
+		text = text[:i]
+	}
+	if strings.Contains(text, "or (at your option) any later version") {
+		return "-or-later"
+	}
+	return "-only"
+}
+
+// licenseRef returns the SPDX license reference for the unrecognized license
+// file of the module or distribution name, e.g.
+// LicenseRef-example.com-foo-LICENSE.custom.
+func licenseRef(name, file string) string {
+	ref := name + "-" + filepath.Base(file)
+	return "LicenseRef-" + strings.Map(func(r rune) rune {
+		if r >= 'a' && r <= 'z' || r >= 'A' && r <= 'Z' || r >= '0' && r <= '9' || r == '.' || r == '-' {
+			return r
+		}
+		return '-'
+	}, ref)
+}
+
+// moduleLicense returns an SPDX license expression for the license files in
+// the directory dir of the module or distribution name, or "" if there are
+// none. Unrecognized license files are referred to with licenseRef.
+func moduleLicense(name, dir string) (string, error) {
+	files, err := licenseFiles(dir)
+	if err != nil {
+		return "", err
+	}
+	var ids []string
+	seen := make(map[string]struct{})
+	for _, f := range files {
+		data, err := os.ReadFile(f)
+		if err != nil {
+			return "", err
+		}
+		id := detectLicense(string(data))
+		if id == "" {
+			id = licenseRef(name, f)
+		}
+		if _, ok := seen[id]; ok {
+			continue
+		}
+		seen[id] = struct{}{}
+		ids = append(ids, id)
+	}
+	return strings.Join(ids, " AND "), nil
+}
+
+// unrecognizedLicenses returns the texts of the license files in the
+// directory dir of the module or distribution name whose license is not
+// recognized, by their licenseRef.
+func unrecognizedLicenses(name, dir string) (map[string]string, error) {
+	files, err := licenseFiles(dir)
+	if err != nil {
+		return nil, err
+	}
+	texts := make(map[string]string)
+	for _, f := range files {
+		data, err := os.ReadFile(f)
+		if err != nil {
+			return nil, err
+		}
+		if detectLicense(string(data)) == "" {
+			texts[licenseRef(name, f)] = string(data)
+		}
+	}
+	return texts, nil
+}
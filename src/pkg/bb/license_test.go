@@ -0,0 +1,124 @@
+// Copyright 2024 the u-root Authors. All rights reserved
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package bb
+
+import (
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestDetectLicense(t *testing.T) {
+	for _, tt := range []struct {
+		name string
+		text string
+		want string
+	}{
+		{
+			name: "bsd-3-clause",
+			text: `Copyright (c) 2009 The Go Authors. All rights reserved.
+
+Redistribution and use in source and binary forms, with or without
+modification, are permitted provided that the following conditions are
+met: ...
+
+   * Neither the name of Google Inc. nor the names of its
+contributors may be used to endorse or promote products derived from
+this software without specific prior written permission.`,
+			want: "BSD-3-Clause",
+		},
+		{
+			name: "bsd-2-clause",
+			text: `Redistribution and use in source and binary forms, with or without
+modification, are permitted provided that the following conditions are met:`,
+			want: "BSD-2-Clause",
+		},
+		{
+			name: "mit",
+			text: `MIT License
+
+Permission is hereby granted, free of charge, to any person obtaining a copy
+of this software and associated documentation files (the "Software")`,
+			want: "MIT",
+		},
+		{
+			name: "apache",
+			text: `
+                                 Apache License
+                           Version 2.0, January 2004
+                        http://www.apache.org/licenses/`,
+			want: "Apache-2.0",
+		},
+		{
+			// GPLv3 mentions the AGPL further down.
+			name: "gpl-3",
+			text: "GNU GENERAL PUBLIC LICENSE\nVersion 3, 29 June 2007\n\n" + strings.Repeat("terms ", titleLen) +
+				"13. Use with the GNU Affero General Public License Version 3.",
+			want: "GPL-3.0-only",
+		},
+		{
+			// The license's own appendix suggests allowing later
+			// versions.
+			name: "gpl-3-appendix",
+			text: "GNU GENERAL PUBLIC LICENSE\nVersion 3, 29 June 2007\n\n" +
+				"How to Apply These Terms to Your New Programs\n\n" +
+				"either version 3 of the License, or\n(at your option) any later version.",
+			want: "GPL-3.0-only",
+		},
+		{
+			name: "gpl-2-or-later",
+			text: "This program is free software; you can redistribute it and/or modify\n" +
+				"it under the terms of the GNU General Public License as published by\n" +
+				"the Free Software Foundation; either version 2 of the License, or\n" +
+				"(at your option) any later version.\n\n" +
+				"GNU GENERAL PUBLIC LICENSE\nVersion 2, June 1991",
+			want: "GPL-2.0-or-later",
+		},
+		{
+			name: "lgpl-2.1",
+			text: "GNU LESSER GENERAL PUBLIC LICENSE\n       Version 2.1, February 1999",
+			want: "LGPL-2.1-only",
+		},
+		{
+			name: "unknown",
+			text: "All rights reserved.",
+			want: "",
+		},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := detectLicense(tt.text); got != tt.want {
+				t.Errorf("detectLicense = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestModuleLicense(t *testing.T) {
+	dir := t.TempDir()
+	for name, text := range map[string]string{
+		"LICENSE-MIT":    "Permission is hereby granted, free of charge, to any person obtaining a copy",
+		"LICENSE-APACHE": "Apache License\nVersion 2.0, January 2004",
+		"COPYING.txt":    "Permission is hereby granted, free of charge, to any person obtaining a copy",
+		"NOTICE":         "Apache License\nVersion 2.0, January 2004",
+		"LICENSE.custom": "All rights reserved.",
+		"license.go":     "package license",
+	} {
+		if err := os.WriteFile(filepath.Join(dir, name), []byte(text), 0o644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	// Files are sorted, each license appears once, and unrecognized
+	// files are referred to.
+	want := "MIT AND Apache-2.0 AND LicenseRef-example.com-foo-LICENSE.custom"
+	if got, err := moduleLicense("example.com/foo", dir); err != nil || got != want {
+		t.Errorf("moduleLicense = %q, %v, want %s", got, err, want)
+	}
+	texts, err := unrecognizedLicenses("example.com/foo", dir)
+	if wantTexts := map[string]string{"LicenseRef-example.com-foo-LICENSE.custom": "All rights reserved."}; err != nil || !reflect.DeepEqual(texts, wantTexts) {
+		t.Errorf("unrecognizedLicenses = %v, %v, want %v", texts, err, wantTexts)
+	}
+}
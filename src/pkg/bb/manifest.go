@@ -0,0 +1,254 @@
+// Copyright 2024 the u-root Authors. All rights reserved
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package bb
+
+import (
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"sort"
+
+	"golang.org/x/tools/go/packages"
+
+	"github.com/u-root/gobusybox/src/pkg/bb/bbinternal"
+	"github.com/u-root/gobusybox/src/pkg/golang"
+)
+
+// Manifest describes the contents of a busybox: its commands, the packages
+// and modules they depend on, and how it was built.
+//
+// BuildBusybox writes it as JSON to Opts.ManifestPath.
+type Manifest struct {
+	// GoVersion is the version of the compiler, as runtime.Version
+	// reports it.
+	GoVersion string `json:"goVersion"`
+
+	GOOS   string `json:"goos"`
+	GOARCH string `json:"goarch"`
+
+	// BuildTags are the build tags used for package discovery and
+	// compilation.
+	BuildTags []string `json:"buildTags,omitempty"`
+
+	// BuildFlags are the flags the busybox was built with, other than the
+	// output path.
+	BuildFlags []string `json:"buildFlags,omitempty"`
+
+	// ModuleMode is true if the busybox was built as a Go module.
+	ModuleMode bool `json:"moduleMode"`
+
+	// Commands are the commands in the busybox, sorted by name.
+	Commands []ManifestCommand `json:"commands"`
+
+	// Packages are the non-standard-library packages the commands depend
+	// on, sorted by package path.
+	Packages []ManifestPackage `json:"packages,omitempty"`
+
+	// Modules are the modules of all commands and packages, sorted by
+	// module path and version.
+	Modules []ManifestModule `json:"modules,omitempty"`
+
+	// goroot is the root of the Go distribution the busybox is built with,
+	// if known, to read its license from.
+	goroot string
+}
+
+// ManifestCommand is a command in a busybox.
+type ManifestCommand struct {
+	Name    string   `json:"name"`
+	Aliases []string `json:"aliases,omitempty"`
+	PkgPath string   `json:"pkgPath"`
+
+	// Module is the path of the command's module. Commands without one
+	// are from GOPATH.
+	Module string `json:"module,omitempty"`
+
+	// dir is the command's directory, if known, to read the license and
+	// notice files of GOPATH commands from.
+	dir string
+}
+
+// ManifestPackage is a dependency package of a busybox's commands.
+type ManifestPackage struct {
+	PkgPath string `json:"pkgPath"`
+
+	// Module is the path of the package's module. Packages without one
+	// are from GOPATH.
+	Module string `json:"module,omitempty"`
+
+	// Rewritten is true if the package's initialization was deferred
+	// with Opts.RewriteDeps.
+	Rewritten bool `json:"rewritten,omitempty"`
+
+	// dir is the package's directory, if known, to read the license and
+	// notice files of GOPATH packages from.
+	dir string
+}
+
+// ManifestModule is a module providing commands or packages of a busybox.
+type ManifestModule struct {
+	Path string `json:"path"`
+
+	// Version is empty for main and workspace modules.
+	Version string `json:"version,omitempty"`
+
+	// Sum is the checksum of the module from go.sum, if any.
+	Sum string `json:"sum,omitempty"`
+
+	// GoVersion is the go version of the module's go.mod.
+	GoVersion string `json:"goVersion,omitempty"`
+
+	// License is an SPDX license expression for the license files found
+	// in the module's root directory, if any were recognized.
+	License string `json:"license,omitempty"`
+
+	// Replace is the module replacing this one, if any.
+	Replace *ManifestModule `json:"replace,omitempty"`
+
+	// dir is the module's directory, if known, to read its license and
+	// notice files from.
+	dir string
+}
+
+// newManifest returns the manifest of a busybox of cmds and their
+// dependencies deps, of which rewritten were rewritten.
+func newManifest(env *golang.Environ, buildOpts *golang.BuildOpts, moduleMode bool, cmds []*bbinternal.Package, deps []*packages.Package, rewritten map[string]*bbinternal.Package) (*Manifest, error) {
+	version, err := env.Version()
+	if err != nil {
+		return nil, err
+	}
+	flags, err := env.BuildFlags(buildOpts)
+	if err != nil {
+		return nil, err
+	}
+	goroot, err := env.GoRoot()
+	if err != nil {
+		return nil, err
+	}
+	m := &Manifest{
+		GoVersion:  version,
+		GOOS:       env.GOOS,
+		GOARCH:     env.GOARCH,
+		BuildTags:  env.BuildTags,
+		BuildFlags: flags,
+		ModuleMode: moduleMode,
+		goroot:     goroot,
+	}
+
+	// Checksums are looked up in the go.sum files of all commands'
+	// modules.
+	var infos buildInfos
+	var sums []map[string]string
+	for _, cmd := range cmds {
+		if cmd.Pkg.Module == nil {
+			continue
+		}
+		s, err := infos.goSum(cmd.Pkg.Module.GoMod)
+		if err != nil {
+			return nil, err
+		}
+		sums = append(sums, s)
+	}
+	mods := make(map[string]*packages.Module)
+	addModule := func(mod *packages.Module) string {
+		if mod == nil {
+			return ""
+		}
+		mods[mod.Path+" "+mod.Version] = mod
+		return mod.Path
+	}
+
+	for _, cmd := range cmds {
+		m.Commands = append(m.Commands, ManifestCommand{
+			Name:    cmd.Name,
+			Aliases: cmd.Aliases,
+			PkgPath: cmd.Pkg.PkgPath,
+			Module:  addModule(cmd.Pkg.Module),
+			dir:     pkgDir(cmd.Pkg),
+		})
+	}
+	sort.Slice(m.Commands, func(i, j int) bool {
+		return m.Commands[i].Name < m.Commands[j].Name
+	})
+
+	for _, p := range deps {
+		_, ok := rewritten[p.ID]
+		m.Packages = append(m.Packages, ManifestPackage{
+			PkgPath:   p.PkgPath,
+			Module:    addModule(p.Module),
+			Rewritten: ok,
+			dir:       pkgDir(p),
+		})
+	}
+	sort.Slice(m.Packages, func(i, j int) bool {
+		return m.Packages[i].PkgPath < m.Packages[j].PkgPath
+	})
+
+	for _, mod := range mods {
+		mm, err := manifestModule(mod, sums)
+		if err != nil {
+			return nil, err
+		}
+		m.Modules = append(m.Modules, *mm)
+	}
+	sort.Slice(m.Modules, func(i, j int) bool {
+		if m.Modules[i].Path != m.Modules[j].Path {
+			return m.Modules[i].Path < m.Modules[j].Path
+		}
+		return m.Modules[i].Version < m.Modules[j].Version
+	})
+	return m, nil
+}
+
+// pkgDir returns the directory of p, or "" if it has no Go files.
+func pkgDir(p *packages.Package) string {
+	if len(p.GoFiles) == 0 {
+		return ""
+	}
+	return filepath.Dir(p.GoFiles[0])
+}
+
+// manifestModule returns mod as recorded in a manifest, with the first
+// checksum found in sums.
+func manifestModule(mod *packages.Module, sums []map[string]string) (*ManifestModule, error) {
+	mm := &ManifestModule{
+		Path:      mod.Path,
+		Version:   mod.Version,
+		GoVersion: mod.GoVersion,
+		dir:       mod.Dir,
+	}
+	if mod.Version != "" && mod.Replace == nil {
+		for _, s := range sums {
+			if sum, ok := s[mod.Path+" "+mod.Version]; ok {
+				mm.Sum = sum
+				break
+			}
+		}
+	}
+	if mod.Dir != "" && mod.Replace == nil {
+		license, err := moduleLicense(mod.Path, mod.Dir)
+		if err != nil {
+			return nil, err
+		}
+		mm.License = license
+	}
+	if mod.Replace != nil {
+		r, err := manifestModule(mod.Replace, sums)
+		if err != nil {
+			return nil, err
+		}
+		mm.Replace = r
+	}
+	return mm, nil
+}
+
+// writeManifest writes m as JSON to the file at path.
+func writeManifest(path string, m *Manifest) error {
+	data, err := json.MarshalIndent(m, "", "\t")
+	if err != nil {
+		return err
+	}
+	return os.WriteFile(path, append(data, '\n'), 0o644)
+}
@@ -0,0 +1,216 @@
+// Copyright 2024 the u-root Authors. All rights reserved
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package bb
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"golang.org/x/exp/maps"
+	"golang.org/x/mod/modfile"
+	"golang.org/x/mod/module"
+	"golang.org/x/mod/semver"
+	"golang.org/x/tools/go/packages"
+
+	"github.com/u-root/gobusybox/src/pkg/bb/bbinternal"
+)
+
+// moduleTree are the modules of a busybox generated in module mode.
+type moduleTree struct {
+	// modules are all modules providing commands and their dependencies,
+	// by module path.
+	modules map[string]*packages.Module
+
+	// local are the paths of modules written into the generated tree,
+	// because they contain rewritten packages or are not in the module
+	// cache.
+	local map[string]struct{}
+}
+
+// newModuleTree returns the modules of cmds and their dependencies deps, of
+// which rewritten are rewritten.
+func newModuleTree(cmds []*bbinternal.Package, deps []*packages.Package, rewritten map[string]*bbinternal.Package) (*moduleTree, error) {
+	t := &moduleTree{
+		modules: make(map[string]*packages.Module),
+		local:   make(map[string]struct{}),
+	}
+	add := func(p *packages.Package, local bool) error {
+		m := p.Module
+		if m == nil {
+			return fmt.Errorf("module mode requires all packages to be in Go modules, but %s is not", p.PkgPath)
+		}
+		t.modules[m.Path] = m
+		// Main modules, workspace modules and directory replacements
+		// are not in the module cache.
+		if local || m.Version == "" || (m.Replace != nil && m.Replace.Version == "") {
+			t.local[m.Path] = struct{}{}
+		}
+		return nil
+	}
+	for _, cmd := range cmds {
+		if err := add(cmd.Pkg, true); err != nil {
+			return nil, err
+		}
+	}
+	for _, p := range deps {
+		_, ok := rewritten[p.ID]
+		if err := add(p, ok); err != nil {
+			return nil, err
+		}
+	}
+	return t, nil
+}
+
+// localPackages returns the packages of pkgs that are in local modules.
+func (t *moduleTree) localPackages(pkgs []*packages.Package) []*packages.Package {
+	var local []*packages.Package
+	for _, p := range pkgs {
+		if _, ok := t.local[p.Module.Path]; ok {
+			local = append(local, p)
+		}
+	}
+	return local
+}
+
+// write writes go.mod and go.sum of the bb.u-root.com/bb module into bbDir,
+// and go.mod files of local modules into their directories in pkgDir.
+//
+// The bb module requires every module at the version selected for the
+// commands, so that the same versions are used. Local modules are replaced
+// by their directories.
+func (t *moduleTree) write(bbDir, pkgDir string) error {
+	f := &modfile.File{}
+	if err := f.AddModuleStmt("bb.u-root.com/bb"); err != nil {
+		return err
+	}
+
+	var goVersion string
+	sums := make(map[string]struct{})
+	// Sort for deterministic output.
+	paths := maps.Keys(t.modules)
+	sort.Strings(paths)
+	for _, path := range paths {
+		m := t.modules[path]
+		if m.GoVersion != "" && semver.Compare("v"+m.GoVersion, "v"+goVersion) > 0 {
+			goVersion = m.GoVersion
+		}
+
+		if _, ok := t.local[path]; !ok {
+			if err := f.AddRequire(path, m.Version); err != nil {
+				return err
+			}
+			if m.Replace != nil {
+				if err := f.AddReplace(path, "", m.Replace.Path, m.Replace.Version); err != nil {
+					return err
+				}
+			}
+			continue
+		}
+
+		dir := filepath.Join(pkgDir, path)
+		if err := writeLocalGoMod(dir, path, m.GoVersion); err != nil {
+			return err
+		}
+		rel, err := filepath.Rel(bbDir, dir)
+		if err != nil {
+			return err
+		}
+		if err := f.AddRequire(path, localVersion(m)); err != nil {
+			return err
+		}
+		if err := f.AddReplace(path, "", filepath.ToSlash(rel), ""); err != nil {
+			return err
+		}
+
+		// The checksums of the modules that were selected for local
+		// modules.
+		if m.GoMod != "" {
+			if err := readGoSum(goSumFile(m.GoMod), sums); err != nil {
+				return err
+			}
+		}
+	}
+	if goVersion != "" {
+		if err := f.AddGoStmt(goVersion); err != nil {
+			return err
+		}
+	}
+
+	f.Cleanup()
+	data, err := f.Format()
+	if err != nil {
+		return err
+	}
+	if err := os.WriteFile(filepath.Join(bbDir, "go.mod"), data, 0o644); err != nil {
+		return err
+	}
+	lines := maps.Keys(sums)
+	sort.Strings(lines)
+	var sum strings.Builder
+	for _, line := range lines {
+		sum.WriteString(line + "\n")
+	}
+	return os.WriteFile(filepath.Join(bbDir, "go.sum"), []byte(sum.String()), 0o644)
+}
+
+// localVersion returns the version to require a local module at.
+func localVersion(m *packages.Module) string {
+	if m.Version != "" {
+		return m.Version
+	}
+	// Main and workspace modules have no version, but versions must match
+	// the major version suffix of the module path.
+	if _, pathMajor, ok := module.SplitPathVersion(m.Path); ok && pathMajor != "" {
+		return strings.TrimLeft(pathMajor, "/.") + ".0.0"
+	}
+	return "v0.0.0"
+}
+
+// writeLocalGoMod writes a go.mod for the local module at path into dir.
+//
+// Its requirements are irrelevant, as the bb module requires all modules.
+func writeLocalGoMod(dir, path, goVersion string) error {
+	f := &modfile.File{}
+	if err := f.AddModuleStmt(path); err != nil {
+		return err
+	}
+	if goVersion != "" {
+		if err := f.AddGoStmt(goVersion); err != nil {
+			return err
+		}
+	}
+	data, err := f.Format()
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(dir, 0o755); err != nil {
+		return err
+	}
+	return os.WriteFile(filepath.Join(dir, "go.mod"), data, 0o644)
+}
+
+// readGoSum adds the lines of the go.sum file at path to sums, if it exists.
+func readGoSum(path string, sums map[string]struct{}) error {
+	f, err := os.Open(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil
+	} else if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	s := bufio.NewScanner(f)
+	for s.Scan() {
+		if line := strings.TrimSpace(s.Text()); line != "" {
+			sums[line] = struct{}{}
+		}
+	}
+	return s.Err()
+}
@@ -0,0 +1,188 @@
+// Copyright 2024 the u-root Authors. All rights reserved
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package bb
+
+import (
+	"bytes"
+	"fmt"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// noticeSeparator separates the sections of a notice file.
+var noticeSeparator = strings.Repeat("=", 80)
+
+// notice returns the aggregated license and notice files of the Go
+// distribution, of all modules in m, in the order of m.Modules, and of the
+// commands and packages from GOPATH.
+//
+// The Go distribution, whose standard library and runtime are in every
+// binary, comes first with the license files in its GOROOT. For each module,
+// the notice names the module and its version, the SPDX license expression
+// detected from its license files, and the text of every LICENSE, LICENCE,
+// COPYING and NOTICE file in the module's root directory. Modules without
+// such files are listed as well, so that they can be checked by hand.
+//
+// GOPATH has no module roots, so the files are taken from the directory of
+// each GOPATH package or, if it has none, from its closest parent directory
+// in the same GOPATH that has them, e.g. the root of its repository. Packages
+// that share such a directory share its section. Packages without any such
+// files get a section of their own.
+func (m *Manifest) notice() ([]byte, error) {
+	gopath, err := m.gopathNoticeDirs()
+	if err != nil {
+		return nil, err
+	}
+	var gopathPaths []string
+	for importPath := range gopath {
+		gopathPaths = append(gopathPaths, importPath)
+	}
+	sort.Strings(gopathPaths)
+
+	var b bytes.Buffer
+	fmt.Fprintf(&b, "This binary contains code from the Go distribution, the following %d Go modules and %d directories in GOPATH.\n", len(m.Modules), len(gopathPaths))
+	if m.goroot != "" {
+		license, err := moduleLicense("go", m.goroot)
+		if err != nil {
+			return nil, err
+		}
+		if err := writeNoticeSection(&b, "Go "+m.GoVersion, license, m.goroot); err != nil {
+			return nil, err
+		}
+	}
+	for _, mod := range m.Modules {
+		title := mod.Path
+		if mod.Version != "" {
+			title += " " + mod.Version
+		}
+		if r := mod.Replace; r != nil {
+			title += " => " + r.Path
+			if r.Version != "" {
+				title += " " + r.Version
+			}
+			mod = *r
+		}
+		if err := writeNoticeSection(&b, title, mod.License, mod.dir); err != nil {
+			return nil, err
+		}
+	}
+	for _, importPath := range gopathPaths {
+		var license string
+		dir := gopath[importPath]
+		if dir != "" {
+			if license, err = moduleLicense(importPath, dir); err != nil {
+				return nil, err
+			}
+		}
+		if err := writeNoticeSection(&b, importPath+" (GOPATH)", license, dir); err != nil {
+			return nil, err
+		}
+	}
+	return b.Bytes(), nil
+}
+
+// gopathNoticeDirs returns the directories with license or notice files of
+// the commands and packages from GOPATH in m, by their import path. Packages
+// without any such files map to "", by their own import path.
+func (m *Manifest) gopathNoticeDirs() (map[string]string, error) {
+	dirs := make(map[string]string)
+	add := func(pkgPath, dir string) error {
+		importPath, dir, err := gopathNoticeDir(pkgPath, dir)
+		if err != nil {
+			return err
+		}
+		dirs[importPath] = dir
+		return nil
+	}
+	for _, cmd := range m.Commands {
+		if cmd.Module == "" {
+			if err := add(cmd.PkgPath, cmd.dir); err != nil {
+				return nil, err
+			}
+		}
+	}
+	for _, p := range m.Packages {
+		if p.Module == "" {
+			if err := add(p.PkgPath, p.dir); err != nil {
+				return nil, err
+			}
+		}
+	}
+	return dirs, nil
+}
+
+// gopathNoticeDir returns the closest directory to the GOPATH package pkgPath
+// in dir, itself or a parent up to its GOPATH src directory, that has license
+// or notice files, and its import path. It returns pkgPath and "" if there is
+// none.
+func gopathNoticeDir(pkgPath, dir string) (string, string, error) {
+	if dir == "" || !strings.HasSuffix(filepath.ToSlash(dir), "/"+pkgPath) {
+		return pkgPath, "", nil
+	}
+	for p, d := pkgPath, dir; p != "."; p, d = path.Dir(p), filepath.Dir(d) {
+		files, err := noticeFiles(d)
+		if err != nil {
+			return "", "", err
+		}
+		if len(files) > 0 {
+			return p, d, nil
+		}
+	}
+	return pkgPath, "", nil
+}
+
+// writeNoticeSection writes a notice section titled title to b, with the
+// SPDX license expression license and the license and notice files in dir,
+// if any.
+func writeNoticeSection(b *bytes.Buffer, title, license, dir string) error {
+	if license == "" {
+		license = "unknown"
+	}
+	fmt.Fprintf(b, "\n%s\n%s\nLicense: %s\n%s\n", noticeSeparator, title, license, noticeSeparator)
+
+	var files []string
+	if dir != "" {
+		var err error
+		files, err = noticeFiles(dir)
+		if err != nil {
+			return err
+		}
+	}
+	if len(files) == 0 {
+		b.WriteString("\nNo license or notice files found.\n")
+	}
+	for _, f := range files {
+		text, err := os.ReadFile(f)
+		if err != nil {
+			return err
+		}
+		fmt.Fprintf(b, "\n--- %s ---\n\n", filepath.Base(f))
+		b.Write(bytes.TrimSpace(text))
+		b.WriteString("\n")
+	}
+	return nil
+}
+
+// writeLicensesSource writes a Go file into the bb main package in bbDir that
+// registers the notice with bbmain.RegisterLicenses, for `bb --licenses`.
+func writeLicensesSource(bbDir string, notice []byte) error {
+	src := fmt.Sprintf(`// Code generated by makebb. DO NOT EDIT.
+
+package main
+
+import %q
+
+func init() {
+	bbmain.RegisterLicenses(licenses)
+}
+
+const licenses = %s
+`, bbmainImportPath, strconv.Quote(string(notice)))
+	return os.WriteFile(filepath.Join(bbDir, "licenses.go"), []byte(src), 0o644)
+}
@@ -0,0 +1,404 @@
+// Copyright 2024 the u-root Authors. All rights reserved
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package bb
+
+import (
+	"crypto/sha1"
+	"encoding/json"
+	"fmt"
+	"net/url"
+	"os"
+	"sort"
+	"strconv"
+	"time"
+)
+
+// spdxDocument is an SPDX 2.3 document in its JSON serialization.
+type spdxDocument struct {
+	SPDXVersion       string             `json:"spdxVersion"`
+	DataLicense       string             `json:"dataLicense"`
+	SPDXID            string             `json:"SPDXID"`
+	Name              string             `json:"name"`
+	DocumentNamespace string             `json:"documentNamespace"`
+	CreationInfo      spdxCreationInfo   `json:"creationInfo"`
+	Packages          []spdxPackage      `json:"packages"`
+	Relationships     []spdxRelationship `json:"relationships"`
+
+	HasExtractedLicensingInfos []spdxExtractedLicense `json:"hasExtractedLicensingInfos,omitempty"`
+}
+
+type spdxCreationInfo struct {
+	Created  string   `json:"created"`
+	Creators []string `json:"creators"`
+}
+
+type spdxPackage struct {
+	Name                  string            `json:"name"`
+	SPDXID                string            `json:"SPDXID"`
+	VersionInfo           string            `json:"versionInfo,omitempty"`
+	DownloadLocation      string            `json:"downloadLocation"`
+	FilesAnalyzed         bool              `json:"filesAnalyzed"`
+	LicenseConcluded      string            `json:"licenseConcluded"`
+	LicenseDeclared       string            `json:"licenseDeclared"`
+	CopyrightText         string            `json:"copyrightText"`
+	Summary               string            `json:"summary,omitempty"`
+	PrimaryPackagePurpose string            `json:"primaryPackagePurpose,omitempty"`
+	ExternalRefs          []spdxExternalRef `json:"externalRefs,omitempty"`
+}
+
+type spdxExternalRef struct {
+	ReferenceCategory string `json:"referenceCategory"`
+	ReferenceType     string `json:"referenceType"`
+	ReferenceLocator  string `json:"referenceLocator"`
+}
+
+type spdxExtractedLicense struct {
+	LicenseID     string `json:"licenseId"`
+	ExtractedText string `json:"extractedText"`
+}
+
+type spdxRelationship struct {
+	SPDXElementID      string `json:"spdxElementId"`
+	RelationshipType   string `json:"relationshipType"`
+	RelatedSPDXElement string `json:"relatedSpdxElement"`
+}
+
+// SPDX returns an SPDX 2.3 JSON SBOM of the busybox named name described by
+// m, created at the given time.
+//
+// The busybox is the described package. It contains a package for each
+// command and depends on a package for each module and for each package from
+// GOPATH, whose version and license are NOASSERTION. The texts of unrecognized
+// license files of modules are included as extracted licensing info.
+func (m *Manifest) SPDX(name string, created time.Time) ([]byte, error) {
+	const (
+		noAssertion = "NOASSERTION"
+		rootID      = "SPDXRef-Package-bb"
+	)
+	doc := &spdxDocument{
+		SPDXVersion:       "SPDX-2.3",
+		DataLicense:       "CC0-1.0",
+		SPDXID:            "SPDXRef-DOCUMENT",
+		Name:              name,
+		DocumentNamespace: m.uuid("spdx"),
+		CreationInfo: spdxCreationInfo{
+			Created:  created.UTC().Format(time.RFC3339),
+			Creators: []string{"Tool: gobusybox-makebb"},
+		},
+		Packages: []spdxPackage{{
+			Name:                  name,
+			SPDXID:                rootID,
+			DownloadLocation:      noAssertion,
+			LicenseConcluded:      noAssertion,
+			LicenseDeclared:       noAssertion,
+			CopyrightText:         noAssertion,
+			Summary:               fmt.Sprintf("Go busybox built with %s for %s/%s", m.GoVersion, m.GOOS, m.GOARCH),
+			PrimaryPackagePurpose: "APPLICATION",
+		}},
+		Relationships: []spdxRelationship{{
+			SPDXElementID:      "SPDXRef-DOCUMENT",
+			RelationshipType:   "DESCRIBES",
+			RelatedSPDXElement: rootID,
+		}},
+	}
+
+	for i, cmd := range m.Commands {
+		id := "SPDXRef-Command-" + strconv.Itoa(i)
+		doc.Packages = append(doc.Packages, spdxPackage{
+			Name:                  cmd.Name,
+			SPDXID:                id,
+			DownloadLocation:      noAssertion,
+			LicenseConcluded:      noAssertion,
+			LicenseDeclared:       noAssertion,
+			CopyrightText:         noAssertion,
+			Summary:               cmd.PkgPath,
+			PrimaryPackagePurpose: "APPLICATION",
+		})
+		doc.Relationships = append(doc.Relationships, spdxRelationship{
+			SPDXElementID:      rootID,
+			RelationshipType:   "CONTAINS",
+			RelatedSPDXElement: id,
+		})
+	}
+
+	for i, mod := range m.Modules {
+		id := "SPDXRef-Module-" + strconv.Itoa(i)
+		license := noAssertion
+		if l := mod.license(); l != "" {
+			license = l
+		}
+		p := spdxPackage{
+			Name:                  mod.Path,
+			SPDXID:                id,
+			VersionInfo:           mod.Version,
+			DownloadLocation:      noAssertion,
+			LicenseConcluded:      noAssertion,
+			LicenseDeclared:       license,
+			CopyrightText:         noAssertion,
+			PrimaryPackagePurpose: "LIBRARY",
+		}
+		if purl := mod.purl(); purl != "" {
+			p.ExternalRefs = append(p.ExternalRefs, spdxExternalRef{
+				ReferenceCategory: "PACKAGE-MANAGER",
+				ReferenceType:     "purl",
+				ReferenceLocator:  purl,
+			})
+		}
+		if sum := mod.sum(); sum != "" {
+			p.ExternalRefs = append(p.ExternalRefs, spdxExternalRef{
+				ReferenceCategory: "OTHER",
+				ReferenceType:     "gosum",
+				ReferenceLocator:  sum,
+			})
+		}
+		doc.Packages = append(doc.Packages, p)
+		doc.Relationships = append(doc.Relationships, spdxRelationship{
+			SPDXElementID:      rootID,
+			RelationshipType:   "DEPENDS_ON",
+			RelatedSPDXElement: id,
+		})
+
+		if r := mod.Replace; r != nil {
+			mod = *r
+		}
+		if mod.dir == "" {
+			continue
+		}
+		texts, err := unrecognizedLicenses(mod.Path, mod.dir)
+		if err != nil {
+			return nil, err
+		}
+		for ref, text := range texts {
+			doc.HasExtractedLicensingInfos = append(doc.HasExtractedLicensingInfos, spdxExtractedLicense{
+				LicenseID:     ref,
+				ExtractedText: text,
+			})
+		}
+	}
+	sort.Slice(doc.HasExtractedLicensingInfos, func(i, j int) bool {
+		return doc.HasExtractedLicensingInfos[i].LicenseID < doc.HasExtractedLicensingInfos[j].LicenseID
+	})
+
+	for i, pkg := range m.Packages {
+		if pkg.Module != "" {
+			continue
+		}
+		id := "SPDXRef-GOPATH-" + strconv.Itoa(i)
+		doc.Packages = append(doc.Packages, spdxPackage{
+			Name:                  pkg.PkgPath,
+			SPDXID:                id,
+			VersionInfo:           noAssertion,
+			DownloadLocation:      noAssertion,
+			LicenseConcluded:      noAssertion,
+			LicenseDeclared:       noAssertion,
+			CopyrightText:         noAssertion,
+			Summary:               "GOPATH package",
+			PrimaryPackagePurpose: "LIBRARY",
+		})
+		doc.Relationships = append(doc.Relationships, spdxRelationship{
+			SPDXElementID:      rootID,
+			RelationshipType:   "DEPENDS_ON",
+			RelatedSPDXElement: id,
+		})
+	}
+	return marshalSBOM(doc)
+}
+
+// cdxBOM is a CycloneDX 1.5 BOM in its JSON serialization.
+type cdxBOM struct {
+	BOMFormat    string          `json:"bomFormat"`
+	SpecVersion  string          `json:"specVersion"`
+	SerialNumber string          `json:"serialNumber"`
+	Version      int             `json:"version"`
+	Metadata     cdxMetadata     `json:"metadata"`
+	Components   []cdxComponent  `json:"components,omitempty"`
+	Dependencies []cdxDependency `json:"dependencies,omitempty"`
+}
+
+type cdxMetadata struct {
+	Timestamp string       `json:"timestamp"`
+	Tools     cdxTools     `json:"tools"`
+	Component cdxComponent `json:"component"`
+}
+
+type cdxTools struct {
+	Components []cdxComponent `json:"components"`
+}
+
+type cdxComponent struct {
+	Type        string         `json:"type"`
+	BOMRef      string         `json:"bom-ref,omitempty"`
+	Name        string         `json:"name"`
+	Version     string         `json:"version,omitempty"`
+	Description string         `json:"description,omitempty"`
+	PURL        string         `json:"purl,omitempty"`
+	Licenses    []cdxLicense   `json:"licenses,omitempty"`
+	Properties  []cdxProperty  `json:"properties,omitempty"`
+	Components  []cdxComponent `json:"components,omitempty"`
+}
+
+type cdxProperty struct {
+	Name  string `json:"name"`
+	Value string `json:"value"`
+}
+
+type cdxLicense struct {
+	Expression string `json:"expression"`
+}
+
+type cdxDependency struct {
+	Ref       string   `json:"ref"`
+	DependsOn []string `json:"dependsOn,omitempty"`
+}
+
+// CycloneDX returns a CycloneDX 1.5 JSON SBOM of the busybox named name
+// described by m, created at the given time.
+//
+// The busybox is the BOM's component, with a sub-component for each command.
+// It depends on a library component for each module and for each package from
+// GOPATH. CycloneDX has no NOASSERTION, so the latter have no version or
+// license.
+func (m *Manifest) CycloneDX(name string, created time.Time) ([]byte, error) {
+	const rootRef = "bb"
+	root := cdxComponent{
+		Type:        "application",
+		BOMRef:      rootRef,
+		Name:        name,
+		Description: fmt.Sprintf("Go busybox built with %s for %s/%s", m.GoVersion, m.GOOS, m.GOARCH),
+	}
+	for _, cmd := range m.Commands {
+		root.Components = append(root.Components, cdxComponent{
+			Type:        "application",
+			BOMRef:      "command:" + cmd.Name,
+			Name:        cmd.Name,
+			Description: cmd.PkgPath,
+		})
+	}
+
+	bom := &cdxBOM{
+		BOMFormat:    "CycloneDX",
+		SpecVersion:  "1.5",
+		SerialNumber: m.uuid("cyclonedx"),
+		Version:      1,
+		Metadata: cdxMetadata{
+			Timestamp: created.UTC().Format(time.RFC3339),
+			Tools: cdxTools{
+				Components: []cdxComponent{{Type: "application", Name: "makebb"}},
+			},
+			Component: root,
+		},
+	}
+
+	deps := cdxDependency{Ref: rootRef}
+	for _, mod := range m.Modules {
+		purl := mod.purl()
+		ref := purl
+		if ref == "" {
+			ref = "module:" + mod.Path
+		}
+		c := cdxComponent{
+			Type:    "library",
+			BOMRef:  ref,
+			Name:    mod.Path,
+			Version: mod.Version,
+			PURL:    purl,
+		}
+		if l := mod.license(); l != "" {
+			c.Licenses = []cdxLicense{{Expression: l}}
+		}
+		if sum := mod.sum(); sum != "" {
+			c.Properties = []cdxProperty{{Name: "gobusybox:gosum", Value: sum}}
+		}
+		bom.Components = append(bom.Components, c)
+		deps.DependsOn = append(deps.DependsOn, ref)
+	}
+	for _, pkg := range m.Packages {
+		if pkg.Module != "" {
+			continue
+		}
+		ref := "package:" + pkg.PkgPath
+		bom.Components = append(bom.Components, cdxComponent{
+			Type:        "library",
+			BOMRef:      ref,
+			Name:        pkg.PkgPath,
+			Description: "GOPATH package",
+		})
+		deps.DependsOn = append(deps.DependsOn, ref)
+	}
+	bom.Dependencies = []cdxDependency{deps}
+	return marshalSBOM(bom)
+}
+
+// license returns the license of the module, or of its replacement.
+func (mod *ManifestModule) license() string {
+	if mod.Replace != nil {
+		return mod.Replace.license()
+	}
+	return mod.License
+}
+
+// purl returns the package URL of the module, or "" if it has no version.
+func (mod *ManifestModule) purl() string {
+	if mod.Replace != nil {
+		// Local directory replacements have no version.
+		return mod.Replace.purl()
+	}
+	if mod.Version == "" {
+		return ""
+	}
+	return "pkg:golang/" + mod.Path + "@" + url.PathEscape(mod.Version)
+}
+
+// sum returns the go.sum checksum of the module, e.g. "h1:...", which hashes
+// the module's file tree as the go command does, not a single file. Local
+// directory replacements have none.
+func (mod *ManifestModule) sum() string {
+	if mod.Replace != nil {
+		return mod.Replace.sum()
+	}
+	return mod.Sum
+}
+
+// uuidNamespace is the namespace of the UUIDs identifying SBOMs: the version
+// 5 UUID of the URL https://github.com/u-root/gobusybox.
+var uuidNamespace = [16]byte{0x61, 0xc4, 0x27, 0x9a, 0x62, 0x14, 0x54, 0x1b, 0xb8, 0xee, 0x3c, 0xa3, 0xc8, 0x04, 0x3d, 0xa8}
+
+// uuid returns a urn:uuid: URN with a name-based version 5 UUID of m for the
+// SBOM format, identifying the busybox in SBOMs without making them
+// unreproducible. Each format gets its own UUID.
+func (m *Manifest) uuid(format string) string {
+	data, _ := json.Marshal(m)
+	h := sha1.New()
+	h.Write(uuidNamespace[:])
+	h.Write([]byte(format + " "))
+	h.Write(data)
+	u := h.Sum(nil)[:16]
+	u[6] = u[6]&0x0f | 0x50
+	u[8] = u[8]&0x3f | 0x80
+	return fmt.Sprintf("urn:uuid:%x-%x-%x-%x-%x", u[0:4], u[4:6], u[6:8], u[8:10], u[10:16])
+}
+
+// marshalSBOM returns v as indented JSON.
+func marshalSBOM(v any) ([]byte, error) {
+	data, err := json.MarshalIndent(v, "", "\t")
+	if err != nil {
+		return nil, err
+	}
+	return append(data, '\n'), nil
+}
+
+// sbomTime returns the creation time for SBOMs: SOURCE_DATE_EPOCH if set, for
+// reproducible builds, or the current time.
+func sbomTime() (time.Time, error) {
+	epoch := os.Getenv("SOURCE_DATE_EPOCH")
+	if epoch == "" {
+		return time.Now(), nil
+	}
+	sec, err := strconv.ParseInt(epoch, 10, 64)
+	if err != nil {
+		return time.Time{}, fmt.Errorf("invalid SOURCE_DATE_EPOCH %q: %v", epoch, err)
+	}
+	return time.Unix(sec, 0), nil
+}
@@ -0,0 +1,110 @@
+// Copyright 2024 the u-root Authors. All rights reserved
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package bb
+
+import (
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"reflect"
+	"regexp"
+	"testing"
+	"time"
+)
+
+func TestSBOMs(t *testing.T) {
+	dir := t.TempDir()
+	for name, text := range map[string]string{
+		"LICENSE":        "Permission is hereby granted, free of charge, to any person obtaining a copy",
+		"LICENSE.custom": "All rights reserved.",
+	} {
+		if err := os.WriteFile(filepath.Join(dir, name), []byte(text), 0o644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	license, err := moduleLicense("example.com/foo", dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	m := &Manifest{
+		GoVersion: "go1.22.0",
+		GOOS:      "linux",
+		GOARCH:    "amd64",
+		Commands:  []ManifestCommand{{Name: "foo", PkgPath: "foo"}},
+		Packages: []ManifestPackage{
+			{PkgPath: "example.com/foo/bar", Module: "example.com/foo"},
+			{PkgPath: "legacy/lib"},
+		},
+		Modules: []ManifestModule{{Path: "example.com/foo", Version: "v1.0.0", License: license, dir: dir}},
+	}
+	created := time.Unix(1700000000, 0)
+
+	data, err := m.SPDX("bb", created)
+	if err != nil {
+		t.Fatalf("SPDX = %v", err)
+	}
+	var spdx struct {
+		DocumentNamespace string
+		Packages          []struct {
+			Name            string
+			VersionInfo     string
+			LicenseDeclared string
+		}
+		HasExtractedLicensingInfos []struct {
+			LicenseID     string
+			ExtractedText string
+		}
+	}
+	if err := json.Unmarshal(data, &spdx); err != nil {
+		t.Fatal(err)
+	}
+	spdxPkgs := make(map[string]string)
+	for _, p := range spdx.Packages {
+		spdxPkgs[p.Name] = p.VersionInfo + " " + p.LicenseDeclared
+	}
+	wantSPDX := map[string]string{
+		"bb":              " NOASSERTION",
+		"foo":             " NOASSERTION",
+		"example.com/foo": "v1.0.0 MIT AND LicenseRef-example.com-foo-LICENSE.custom",
+		"legacy/lib":      "NOASSERTION NOASSERTION",
+	}
+	if !reflect.DeepEqual(spdxPkgs, wantSPDX) {
+		t.Errorf("SPDX packages = %v, want %v", spdxPkgs, wantSPDX)
+	}
+	if len(spdx.HasExtractedLicensingInfos) != 1 || spdx.HasExtractedLicensingInfos[0].LicenseID != "LicenseRef-example.com-foo-LICENSE.custom" || spdx.HasExtractedLicensingInfos[0].ExtractedText != "All rights reserved." {
+		t.Errorf("SPDX extracted licenses = %+v, want the text of LICENSE.custom", spdx.HasExtractedLicensingInfos)
+	}
+
+	data, err = m.CycloneDX("bb", created)
+	if err != nil {
+		t.Fatalf("CycloneDX = %v", err)
+	}
+	var cdx struct {
+		SerialNumber string
+		Components   []struct {
+			BOMRef  string `json:"bom-ref"`
+			Version string
+		}
+	}
+	if err := json.Unmarshal(data, &cdx); err != nil {
+		t.Fatal(err)
+	}
+	var refs []string
+	for _, c := range cdx.Components {
+		refs = append(refs, c.BOMRef+" "+c.Version)
+	}
+	if want := []string{"pkg:golang/example.com/foo@v1.0.0 v1.0.0", "package:legacy/lib "}; !reflect.DeepEqual(refs, want) {
+		t.Errorf("CycloneDX components = %q, want %q", refs, want)
+	}
+
+	// Both are version 5 UUIDs, which differ between the formats.
+	v5 := regexp.MustCompile(`^urn:uuid:[0-9a-f]{8}-[0-9a-f]{4}-5[0-9a-f]{3}-[89ab][0-9a-f]{3}-[0-9a-f]{12}$`)
+	if !v5.MatchString(spdx.DocumentNamespace) || !v5.MatchString(cdx.SerialNumber) || spdx.DocumentNamespace == cdx.SerialNumber {
+		t.Errorf("SPDX namespace %q and CycloneDX serial number %q, want distinct version 5 UUID URNs", spdx.DocumentNamespace, cdx.SerialNumber)
+	}
+	if again := m.uuid("spdx"); again != spdx.DocumentNamespace {
+		t.Errorf("uuid = %q, then %q, want the same", spdx.DocumentNamespace, again)
+	}
+}
@@ -0,0 +1,130 @@
+// Copyright 2024 the u-root Authors. All rights reserved
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package bb
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"text/template"
+
+	"github.com/u-root/gobusybox/src/pkg/golang"
+	"github.com/u-root/uio/ulog"
+)
+
+// Target is a platform to build busyboxes for.
+type Target struct {
+	GOOS   string
+	GOARCH string
+}
+
+// ParseTarget parses a target given as GOOS/GOARCH, e.g. linux/arm64.
+func ParseTarget(s string) (Target, error) {
+	goos, goarch, ok := strings.Cut(s, "/")
+	if !ok || goos == "" || goarch == "" || strings.Contains(goarch, "/") {
+		return Target{}, fmt.Errorf("invalid target %q, want GOOS/GOARCH", s)
+	}
+	return Target{GOOS: goos, GOARCH: goarch}, nil
+}
+
+// String returns t as GOOS/GOARCH.
+func (t Target) String() string {
+	return t.GOOS + "/" + t.GOARCH
+}
+
+// Expand executes the text/template path with t, e.g. bb-{{.GOOS}}-{{.GOARCH}}
+// becomes bb-linux-arm64.
+func (t Target) Expand(path string) (string, error) {
+	tmpl, err := template.New("path").Parse(path)
+	if err != nil {
+		return "", fmt.Errorf("invalid output path template %q: %v", path, err)
+	}
+	var b strings.Builder
+	if err := tmpl.Execute(&b, t); err != nil {
+		return "", fmt.Errorf("invalid output path template %q: %v", path, err)
+	}
+	return b.String(), nil
+}
+
+// targetOpts returns the options to build opts' busyboxes for t with: t's Go
+// environment, generated source directory and output paths.
+func (opts *Opts) targetOpts(t Target) (*Opts, error) {
+	o := *opts
+	o.Targets = nil
+	o.Env = opts.Env.Copy(golang.WithGOOS(t.GOOS), golang.WithGOARCH(t.GOARCH))
+	if opts.GenSrcDir != "" {
+		o.GenSrcDir = filepath.Join(opts.GenSrcDir, t.GOOS+"_"+t.GOARCH)
+	}
+	o.Groups = append([]Group(nil), opts.Groups...)
+	paths := []*string{&o.BinaryPath, &o.ManifestPath, &o.SPDXPath, &o.CycloneDXPath, &o.NoticePath}
+	for i := range o.Groups {
+		paths = append(paths, &o.Groups[i].BinaryPath)
+	}
+	for _, path := range paths {
+		var err error
+		if *path, err = t.Expand(*path); err != nil {
+			return nil, err
+		}
+	}
+	return &o, nil
+}
+
+// buildTargets builds opts' busyboxes for each of opts.Targets.
+//
+// Each target is built on its own, but they share a rewrite cache, so that
+// copied packages that are the same for several targets are copied once, and
+// packages rewritten the same for several targets are stored once.
+func buildTargets(l ulog.Logger, opts *Opts) error {
+	targetOpts := make([]*Opts, 0, len(opts.Targets))
+	targets := make(map[Target]struct{})
+	outputs := make(map[string]Target)
+	for _, t := range opts.Targets {
+		if t.GOOS == "" || t.GOARCH == "" || strings.Contains(t.GOOS+t.GOARCH, "/") {
+			return fmt.Errorf("invalid target %q", t)
+		}
+		if _, ok := targets[t]; ok {
+			return fmt.Errorf("duplicate target %s", t)
+		}
+		targets[t] = struct{}{}
+
+		o, err := opts.targetOpts(t)
+		if err != nil {
+			return err
+		}
+		paths := []string{o.BinaryPath, o.ManifestPath, o.SPDXPath, o.CycloneDXPath, o.NoticePath}
+		for _, g := range o.Groups {
+			paths = append(paths, g.BinaryPath)
+		}
+		for _, path := range paths {
+			if path == "" {
+				continue
+			}
+			if other, ok := outputs[path]; ok {
+				return fmt.Errorf("targets %s and %s would both be written to %s; use {{.GOOS}} and {{.GOARCH}} in output paths", other, t, path)
+			}
+			outputs[path] = t
+		}
+		targetOpts = append(targetOpts, o)
+	}
+
+	cacheDir := opts.CacheDir
+	if cacheDir == "" && len(targetOpts) > 1 {
+		dir, err := os.MkdirTemp("", "bb-cache-")
+		if err != nil {
+			return err
+		}
+		defer os.RemoveAll(dir)
+		cacheDir = dir
+	}
+	for _, o := range targetOpts {
+		l.Printf("Building busybox for %s/%s", o.Env.GOOS, o.Env.GOARCH)
+		o.CacheDir = cacheDir
+		if err := BuildBusybox(l, o); err != nil {
+			return fmt.Errorf("building busybox for %s/%s failed: %w", o.Env.GOOS, o.Env.GOARCH, err)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,29 @@
+// Copyright 2024 the u-root Authors. All rights reserved
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+// buildinfo prints its own build info.
+package main
+
+import (
+	"fmt"
+	"log"
+	"runtime/debug"
+	"strings"
+
+	"github.com/u-root/uio/uio"
+)
+
+func main() {
+	if _, err := uio.ReadAll(strings.NewReader("")); err != nil {
+		log.Fatal(err)
+	}
+	info, ok := debug.ReadBuildInfo()
+	if !ok {
+		log.Fatal("no build info")
+	}
+	fmt.Println(info.Path, info.Main.Path, info.Main.Version)
+	for _, dep := range info.Deps {
+		fmt.Println(dep.Path, dep.Version)
+	}
+}
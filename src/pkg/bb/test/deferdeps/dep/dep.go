@@ -0,0 +1,27 @@
+// Copyright 2024 the u-root Authors. All rights reserved
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+// Package dep announces its initialization, which is deferred to the
+// commands using it with RewriteDeps.
+package dep
+
+import (
+	"flag"
+	"fmt"
+)
+
+// Greeting is initialized by a global variable initializer.
+var Greeting = initialized("var", "hello")
+
+// Name is a flag registered on flag.CommandLine.
+var Name = flag.String("name", "world", "name to greet")
+
+func init() {
+	initialized("init", "")
+}
+
+func initialized(what, value string) string {
+	fmt.Printf("dep %s initialized\n", what)
+	return value
+}
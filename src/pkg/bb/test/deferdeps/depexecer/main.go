@@ -0,0 +1,26 @@
+// Copyright 2024 the u-root Authors. All rights reserved
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+// depexecer runs usesdep in process twice.
+package main
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"log"
+
+	"github.com/u-root/gobusybox/src/pkg/bb/bbmain"
+)
+
+func main() {
+	for _, args := range [][]string{{"-name=gopher"}, nil} {
+		var out bytes.Buffer
+		code, err := bbmain.Exec(context.Background(), "usesdep", args, nil, &out, &out)
+		if err != nil {
+			log.Fatal(err)
+		}
+		fmt.Printf("%d %q\n", code, out.String())
+	}
+}
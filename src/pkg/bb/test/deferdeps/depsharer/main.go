@@ -0,0 +1,39 @@
+// Copyright 2024 the u-root Authors. All rights reserved
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+// depsharer uses dep and runs usesdep, which also uses it, in process.
+package main
+
+import (
+	"bytes"
+	"context"
+	"flag"
+	"fmt"
+	"log"
+
+	"github.com/u-root/gobusybox/src/pkg/bb/bbmain"
+	"github.com/u-root/gobusybox/src/pkg/bb/test/deferdeps/dep"
+)
+
+func main() {
+	flag.Parse()
+	for _, args := range [][]string{nil, {"-name=gopher"}} {
+		var out bytes.Buffer
+		code, err := bbmain.Exec(context.Background(), "usesdep", args, nil, &out, &out)
+		if err != nil {
+			log.Fatal(err)
+		}
+		fmt.Printf("%d %q\n", code, firstLine(out.String()))
+	}
+
+	// The nested runs use dep as initialized for this command.
+	fmt.Println(dep.Greeting, *dep.Name)
+}
+
+func firstLine(s string) string {
+	if i := bytes.IndexByte([]byte(s), '\n'); i >= 0 {
+		return s[:i]
+	}
+	return s
+}
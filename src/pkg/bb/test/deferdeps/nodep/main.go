@@ -0,0 +1,12 @@
+// Copyright 2024 the u-root Authors. All rights reserved
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+// nodep does not use the dep package.
+package main
+
+import "fmt"
+
+func main() {
+	fmt.Println("nodep")
+}
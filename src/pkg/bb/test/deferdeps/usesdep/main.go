@@ -0,0 +1,18 @@
+// Copyright 2024 the u-root Authors. All rights reserved
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+// usesdep greets with the dep package's greeting and flag.
+package main
+
+import (
+	"flag"
+	"fmt"
+
+	"github.com/u-root/gobusybox/src/pkg/bb/test/deferdeps/dep"
+)
+
+func main() {
+	flag.Parse()
+	fmt.Println(dep.Greeting, *dep.Name)
+}
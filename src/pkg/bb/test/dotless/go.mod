@@ -0,0 +1,7 @@
+module mytool
+
+go 1.20
+
+require corp/lib v0.0.0
+
+replace corp/lib => ./lib
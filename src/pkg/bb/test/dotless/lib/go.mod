@@ -0,0 +1,3 @@
+module corp/lib
+
+go 1.20
@@ -0,0 +1,11 @@
+// Copyright 2024 the u-root Authors. All rights reserved
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+// Package greet is in a module whose path has no dot.
+package greet
+
+// Hello returns a greeting.
+func Hello() string {
+	return "hello from corp/lib"
+}
@@ -0,0 +1,17 @@
+// Copyright 2024 the u-root Authors. All rights reserved
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+// mytool is a command in a module whose path has no dot, using a package of
+// another such module.
+package main
+
+import (
+	"fmt"
+
+	"corp/lib/greet"
+)
+
+func main() {
+	fmt.Println(greet.Hello())
+}
@@ -0,0 +1,40 @@
+// Copyright 2024 the u-root Authors. All rights reserved
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+// execer runs the exits command in process.
+package main
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"log"
+	"os"
+
+	"github.com/u-root/gobusybox/src/pkg/bb/bbmain"
+)
+
+func main() {
+	for _, args := range [][]string{nil, {"-code=3"}, {"-nope"}, {"-code=4", "-how=method-value"}, {"-code=5", "-how=method-expr"}, nil} {
+		var out bytes.Buffer
+		code, err := bbmain.Exec(context.Background(), "exits", args, nil, &out, &out)
+		if err != nil {
+			log.Fatal(err)
+		}
+		fmt.Printf("%d %q\n", code, firstLine(out.String()))
+	}
+
+	// RunInProcess runs the command with the busybox's own arguments and
+	// standard I/O.
+	os.Args = []string{"exits", "-code=6"}
+	code, err := bbmain.RunInProcess("exits")
+	fmt.Printf("%d %v\n", code, err)
+}
+
+func firstLine(s string) string {
+	if i := bytes.IndexByte([]byte(s), '\n'); i >= 0 {
+		return s[:i]
+	}
+	return s
+}
@@ -0,0 +1,10 @@
+// Copyright 2024 the u-root Authors. All rights reserved
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import "os"
+
+// exit is the only use of package os in this file.
+var exit = os.Exit
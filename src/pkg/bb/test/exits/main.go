@@ -0,0 +1,33 @@
+// Copyright 2024 the u-root Authors. All rights reserved
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"flag"
+	"fmt"
+	"log"
+	"os"
+)
+
+func main() {
+	fs := flag.NewFlagSet("exits", flag.ExitOnError)
+	code := fs.Int("code", 0, "exit code")
+	how := fs.String("how", "call", "how to exit: call, method-value or method-expr")
+	fs.Parse(os.Args[1:])
+
+	if *code != 0 {
+		l := log.New(os.Stderr, "", 0)
+		switch *how {
+		case "method-value":
+			fatalf := l.Fatalf
+			fatalf("exit %d", *code)
+		case "method-expr":
+			(*log.Logger).Fatalf(l, "exit %d", *code)
+		}
+		l.Fatalf("exit %d", *code)
+	}
+	fmt.Println("ok")
+	exit(0)
+}
@@ -0,0 +1,18 @@
+// Copyright 2024 the u-root Authors. All rights reserved
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+//go:debug panicnil=1
+
+// godebug prints what recover returns for panic(nil), which depends on its
+// default GODEBUG settings.
+package main
+
+import "fmt"
+
+func main() {
+	defer func() {
+		fmt.Println(recover())
+	}()
+	panic(nil)
+}
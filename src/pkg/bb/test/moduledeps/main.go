@@ -0,0 +1,22 @@
+// Copyright 2024 the u-root Authors. All rights reserved
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+// moduledeps uses a package of another module.
+package main
+
+import (
+	"fmt"
+	"log"
+	"strings"
+
+	"github.com/u-root/uio/uio"
+)
+
+func main() {
+	b, err := uio.ReadAll(strings.NewReader("uio"))
+	if err != nil {
+		log.Fatal(err)
+	}
+	fmt.Println(string(b))
+}
@@ -0,0 +1,39 @@
+// Copyright 2024 the u-root Authors. All rights reserved
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	_ "embed"
+	"fmt"
+)
+
+//go:embed data.txt
+var data string
+
+var (
+	count int
+	set   = setCount()
+	_     int
+)
+
+// Variables without initializer are reset to their zero value whenever the
+// command's init runs, before its init functions, which set local.n again.
+// State outside of the command, e.g. in its dependencies, is not reset.
+var local struct {
+	n int
+}
+
+func init() {
+	local.n = 2
+}
+
+func setCount() bool {
+	count = 1
+	return true
+}
+
+func main() {
+	fmt.Println(data, count, set, local.n)
+}
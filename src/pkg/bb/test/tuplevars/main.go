@@ -0,0 +1,29 @@
+// Copyright 2024 the u-root Authors. All rights reserved
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"fmt"
+	"strconv"
+)
+
+var m = map[string]int{"a": 1}
+
+var (
+	a, ok      = m["a"]
+	n, err     = strconv.Atoi("42")
+	_, missing = m["b"]
+	s, i       = "s", 2
+)
+
+var x, y = pair()
+
+func pair() (string, []byte) {
+	return "x", []byte("y")
+}
+
+func main() {
+	fmt.Println(a, ok, n, err, missing, s, i, x, string(y))
+}
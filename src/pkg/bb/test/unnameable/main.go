@@ -0,0 +1,30 @@
+// Copyright 2024 the u-root Authors. All rights reserved
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"fmt"
+	"os"
+
+	"github.com/u-root/gobusybox/src/pkg/bb/test/unnameablelib"
+)
+
+var (
+	c      = unnameablelib.NewCounter()
+	d      = unnameablelib.Default
+	e, err = unnameablelib.Pair()
+	v      = unnameablelib.NewVariadic(1, 2, 3)
+	s      = unnameablelib.NewSecret()
+
+	// any is an alias, which is named like interface{}.
+	cfg        = map[string]any{"a": 1}
+	val, found = cfg[os.Getenv("UNNAMEABLE_KEY")]
+	a, aErr    = unnameablelib.Lookup("k")
+)
+
+func main() {
+	fmt.Println(c.Inc(), d.Inc(), e.Inc(), err, v.Inc(), s.Name)
+	fmt.Println(val, found, a, aErr)
+}
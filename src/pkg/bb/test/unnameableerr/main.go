@@ -0,0 +1,17 @@
+// Copyright 2024 the u-root Authors. All rights reserved
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"fmt"
+
+	"github.com/u-root/gobusybox/src/pkg/bb/test/unnameablelib"
+)
+
+var c = unnameablelib.NewCounter().Self()
+
+func main() {
+	fmt.Println(c.Inc())
+}
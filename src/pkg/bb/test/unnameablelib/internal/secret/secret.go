@@ -0,0 +1,11 @@
+// Copyright 2024 the u-root Authors. All rights reserved
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+// Package secret cannot be imported by the unnameable test command.
+package secret
+
+// Secret is a type the unnameable test command cannot name.
+type Secret struct {
+	Name string
+}
@@ -0,0 +1,59 @@
+// Copyright 2024 the u-root Authors. All rights reserved
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+// Package unnameablelib returns values of types its importers cannot name.
+package unnameablelib
+
+import (
+	"errors"
+
+	"github.com/u-root/gobusybox/src/pkg/bb/test/unnameablelib/internal/secret"
+)
+
+type counter struct {
+	n int
+}
+
+// Inc increments the counter and returns its value.
+func (c *counter) Inc() int {
+	c.n++
+	return c.n
+}
+
+// Self returns c.
+func (c *counter) Self() *counter {
+	return c
+}
+
+// Default is a counter.
+var Default = &counter{n: 10}
+
+// NewCounter returns a new counter.
+func NewCounter() *counter {
+	return &counter{}
+}
+
+// NewVariadic returns a counter starting at the sum of ns.
+func NewVariadic(ns ...int) *counter {
+	c := &counter{}
+	for _, n := range ns {
+		c.n += n
+	}
+	return c
+}
+
+// Pair returns a counter and an error.
+func Pair() (*counter, error) {
+	return &counter{n: 20}, errors.New("pair")
+}
+
+// NewSecret returns a type of an internal package.
+func NewSecret() secret.Secret {
+	return secret.Secret{Name: "secret"}
+}
+
+// Lookup returns a value of the alias type any.
+func Lookup(key string) (any, error) {
+	return "value of " + key, nil
+}
@@ -0,0 +1,158 @@
+// Copyright 2024 the u-root Authors. All rights reserved
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package bb
+
+import (
+	"fmt"
+	"os"
+	"sort"
+	"strings"
+
+	"golang.org/x/mod/modfile"
+	"golang.org/x/mod/semver"
+	"golang.org/x/tools/go/packages"
+
+	"github.com/u-root/gobusybox/src/pkg/bb/bbinternal"
+	"github.com/u-root/uio/ulog"
+)
+
+// versionSkew is a module that a command's dependencies come from at another
+// version than the command's go.mod requires.
+//
+// A busybox has only one version of each module, the one selected for all
+// commands together, e.g. in a Go workspace.
+type versionSkew struct {
+	// cmd is the name of the command.
+	cmd string
+
+	module string
+
+	// required is the version required by the command's go.mod.
+	required string
+
+	// selected is the version the busybox uses, or "" if it uses the
+	// module from dir: a workspace module or a directory replacement.
+	selected string
+	dir      string
+}
+
+func (s versionSkew) String() string {
+	if s.selected == "" {
+		return fmt.Sprintf("%s %s required, directory %s used", s.module, s.required, s.dir)
+	}
+	change := "upgrade"
+	if semver.Compare(s.selected, s.required) < 0 {
+		change = "downgrade"
+	}
+	return fmt.Sprintf("%s %s => %s (%s)", s.module, s.required, s.selected, change)
+}
+
+// significant returns true if the selected version has another major or
+// minor version than the required one.
+func (s versionSkew) significant() bool {
+	return s.selected != "" && semver.MajorMinor(s.selected) != semver.MajorMinor(s.required)
+}
+
+// versionSkews returns the modules of each command's dependencies that are
+// used at other versions than the command's go.mod requires, sorted by
+// command name and module path.
+//
+// Modules that a command's go.mod does not require or replaces itself are
+// not compared. Neither are the modules of commands whose go.mod cannot be
+// parsed, e.g. because it has directives unknown to this version of makebb,
+// which is logged to l.
+func versionSkews(l ulog.Logger, cmds []*bbinternal.Package) ([]versionSkew, error) {
+	goMods := make(map[string]*modfile.File)
+	var skews []versionSkew
+	for _, cmd := range cmds {
+		m := cmd.Pkg.Module
+		if m == nil {
+			continue
+		}
+		goMod := m.GoMod
+		if m.Replace != nil && m.Replace.GoMod != "" {
+			goMod = m.Replace.GoMod
+		}
+		if goMod == "" {
+			continue
+		}
+		f, ok := goMods[goMod]
+		if !ok {
+			data, err := os.ReadFile(goMod)
+			if err != nil {
+				return nil, err
+			}
+			// ParseLax would ignore unknown directives, but
+			// also replace directives, which would make
+			// replaced modules look skewed.
+			f, err = modfile.Parse(goMod, data, nil)
+			if err != nil {
+				l.Printf("Warning: not comparing module versions of commands in %s with the busybox's: %v", goMod, err)
+			}
+			goMods[goMod] = f
+		}
+		if f == nil {
+			continue
+		}
+
+		required := make(map[string]string)
+		for _, r := range f.Require {
+			required[r.Mod.Path] = r.Mod.Version
+		}
+		for _, r := range f.Replace {
+			delete(required, r.Old.Path)
+		}
+
+		mods := make(map[string]*packages.Module)
+		packages.Visit([]*packages.Package{cmd.Pkg}, nil, func(p *packages.Package) {
+			if p.Module != nil && p.Module.Path != m.Path {
+				mods[p.Module.Path] = p.Module
+			}
+		})
+		for _, mod := range mods {
+			want, ok := required[mod.Path]
+			if !ok {
+				continue
+			}
+			s := versionSkew{cmd: cmd.Name, module: mod.Path, required: want, selected: mod.Version, dir: mod.Dir}
+			if r := mod.Replace; r != nil {
+				s.selected, s.dir = r.Version, r.Dir
+			}
+			if s.selected != s.required {
+				skews = append(skews, s)
+			}
+		}
+	}
+	sort.Slice(skews, func(i, j int) bool {
+		if skews[i].cmd != skews[j].cmd {
+			return skews[i].cmd < skews[j].cmd
+		}
+		return skews[i].module < skews[j].module
+	})
+	return skews, nil
+}
+
+// checkVersionSkews logs the version skews of cmds, by command. If fail is
+// set, it returns an error naming the significant ones.
+func checkVersionSkews(l ulog.Logger, cmds []*bbinternal.Package, fail bool) error {
+	skews, err := versionSkews(l, cmds)
+	if err != nil {
+		return fmt.Errorf("comparing module versions failed: %v", err)
+	}
+	var significant []string
+	for i, s := range skews {
+		if i == 0 || skews[i-1].cmd != s.cmd {
+			l.Printf("Command %s uses other module versions than its go.mod requires:", s.cmd)
+		}
+		l.Printf("  %s", s)
+		if s.significant() {
+			significant = append(significant, fmt.Sprintf("%s: %s", s.cmd, s))
+		}
+	}
+	if fail && len(significant) > 0 {
+		return fmt.Errorf("commands would be built with other major or minor versions of modules than they require:\n%s", strings.Join(significant, "\n"))
+	}
+	return nil
+}
@@ -0,0 +1,136 @@
+// Copyright 2024 the u-root Authors. All rights reserved
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package bb
+
+import (
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+
+	"golang.org/x/tools/go/packages"
+
+	"github.com/u-root/gobusybox/src/pkg/bb/bbinternal"
+	"github.com/u-root/uio/ulog/ulogtest"
+)
+
+func TestVersionSkews(t *testing.T) {
+	dir := t.TempDir()
+	goMod := filepath.Join(dir, "go.mod")
+	if err := os.WriteFile(goMod, []byte(`module example.com/cmds
+
+go 1.21
+
+require (
+	example.com/patch v1.2.0
+	example.com/minor v1.0.0
+	example.com/major v1.0.0
+	example.com/down v1.3.0
+	example.com/workspace v1.0.0
+	example.com/replaced v1.0.0
+	example.com/same v1.0.0
+)
+
+replace example.com/replaced => ../replaced
+`), 0o644); err != nil {
+		t.Fatal(err)
+	}
+
+	dep := func(path, version string) *packages.Package {
+		return &packages.Package{ID: path, PkgPath: path, Module: &packages.Module{Path: path, Version: version}}
+	}
+	workspace := dep("example.com/workspace", "")
+	workspace.Module.Dir = "/src/workspace"
+	cmd := &packages.Package{
+		ID:      "example.com/cmds/ls",
+		PkgPath: "example.com/cmds/ls",
+		Module:  &packages.Module{Path: "example.com/cmds", GoMod: goMod},
+		Imports: map[string]*packages.Package{
+			"example.com/patch":     dep("example.com/patch", "v1.2.3"),
+			"example.com/minor":     dep("example.com/minor", "v1.1.0"),
+			"example.com/major":     dep("example.com/major", "v2.0.0+incompatible"),
+			"example.com/down":      dep("example.com/down", "v1.2.9"),
+			"example.com/workspace": workspace,
+			"example.com/replaced":  dep("example.com/replaced", "v1.5.0"),
+			"example.com/same":      dep("example.com/same", "v1.0.0"),
+			"example.com/other":     dep("example.com/other", "v0.1.0"),
+			"fmt":                   {ID: "fmt", PkgPath: "fmt"},
+		},
+	}
+	cmds := []*bbinternal.Package{bbinternal.NewPackage("ls", cmd)}
+
+	l := &ulogtest.Logger{TB: t}
+	skews, err := versionSkews(l, cmds)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var got []string
+	var significant []string
+	for _, s := range skews {
+		got = append(got, s.String())
+		if s.significant() {
+			significant = append(significant, s.module)
+		}
+	}
+	want := []string{
+		"example.com/down v1.3.0 => v1.2.9 (downgrade)",
+		"example.com/major v1.0.0 => v2.0.0+incompatible (upgrade)",
+		"example.com/minor v1.0.0 => v1.1.0 (upgrade)",
+		"example.com/patch v1.2.0 => v1.2.3 (upgrade)",
+		"example.com/workspace v1.0.0 required, directory /src/workspace used",
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("versionSkews = %q, want %q", got, want)
+	}
+	wantSignificant := []string{"example.com/down", "example.com/major", "example.com/minor"}
+	if !reflect.DeepEqual(significant, wantSignificant) {
+		t.Errorf("significant skews = %v, want %v", significant, wantSignificant)
+	}
+
+	if err := checkVersionSkews(l, cmds, false); err != nil {
+		t.Errorf("checkVersionSkews = %v, want nil", err)
+	}
+	err = checkVersionSkews(l, cmds, true)
+	if err == nil || !strings.Contains(err.Error(), "ls: example.com/minor v1.0.0 => v1.1.0 (upgrade)") || strings.Contains(err.Error(), "example.com/patch") {
+		t.Errorf("checkVersionSkews = %v, want error about significant skews only", err)
+	}
+}
+
+func TestVersionSkewsUnparsable(t *testing.T) {
+	dir := t.TempDir()
+	goMod := filepath.Join(dir, "go.mod")
+	// An unknown directive, which ParseLax would ignore along with the
+	// replace directive.
+	if err := os.WriteFile(goMod, []byte(`module example.com/cmds
+
+go 1.21
+
+frobnicate example.com/tool
+
+require example.com/replaced v1.0.0
+
+replace example.com/replaced => ../replaced
+`), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	cmd := &packages.Package{
+		ID:      "example.com/cmds/ls",
+		PkgPath: "example.com/cmds/ls",
+		Module:  &packages.Module{Path: "example.com/cmds", GoMod: goMod},
+		Imports: map[string]*packages.Package{
+			"example.com/replaced": {
+				ID:      "example.com/replaced",
+				PkgPath: "example.com/replaced",
+				Module:  &packages.Module{Path: "example.com/replaced", Version: "v1.5.0"},
+			},
+		},
+	}
+
+	skews, err := versionSkews(&ulogtest.Logger{TB: t}, []*bbinternal.Package{bbinternal.NewPackage("ls", cmd)})
+	if err != nil || len(skews) != 0 {
+		t.Errorf("versionSkews = (%v, %v), want no skews", skews, err)
+	}
+}
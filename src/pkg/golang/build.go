@@ -6,6 +6,7 @@
 package golang
 
 import (
+	"bytes"
 	"flag"
 	"fmt"
 	"go/build"
@@ -15,6 +16,7 @@ import (
 	"strings"
 
 	"github.com/u-root/gobusybox/src/pkg/uflag"
+	"golang.org/x/mod/semver"
 	"golang.org/x/tools/go/packages"
 )
 
@@ -32,9 +34,15 @@ type Environ struct {
 	build.Context
 
 	GO111MODULE string
+	GOWORK      string
 	Mod         ModBehavior
 	GBBDEBUG    bool
 
+	// NoModuleGOFLAGS removes -mod and -modfile from the GOFLAGS inherited
+	// from the environment, which are meant for the user's module, not
+	// e.g. for a generated module or for GOPATH mode.
+	NoModuleGOFLAGS bool
+
 	Compiler Compiler
 }
 
@@ -43,9 +51,12 @@ func (c *Environ) Copy(opts ...Opt) *Environ {
 	e := &Environ{
 		Context:     c.Context,
 		GO111MODULE: c.GO111MODULE,
+		GOWORK:      c.GOWORK,
 		Mod:         c.Mod,
 		GBBDEBUG:    c.GBBDEBUG,
 		Compiler:    c.Compiler,
+
+		NoModuleGOFLAGS: c.NoModuleGOFLAGS,
 	}
 	e.Apply(opts...)
 	return e
@@ -142,6 +153,14 @@ func WithGO111MODULE(go111module string) Opt {
 	}
 }
 
+// WithGOWORK is an option that overrides GOWORK. Unless overridden, GOWORK is
+// inherited from the environment.
+func WithGOWORK(gowork string) Opt {
+	return func(c *Environ) {
+		c.GOWORK = gowork
+	}
+}
+
 // WithMod is an option that overrides module behavior.
 func WithMod(mod ModBehavior) Opt {
 	return func(c *Environ) {
@@ -149,6 +168,14 @@ func WithMod(mod ModBehavior) Opt {
 	}
 }
 
+// WithoutModuleGOFLAGS is an option that removes -mod and -modfile from the
+// GOFLAGS inherited from the environment.
+func WithoutModuleGOFLAGS() Opt {
+	return func(c *Environ) {
+		c.NoModuleGOFLAGS = true
+	}
+}
+
 // WithWorkingDir sets the working directory for calls to `go`.
 func WithWorkingDir(wd string) Opt {
 	return func(c *Environ) {
@@ -200,6 +227,48 @@ func (c *Environ) Lookup(mode packages.LoadMode, patterns ...string) ([]*package
 	return packages.Load(cfg, patterns...)
 }
 
+// DefaultGODEBUG returns the default GODEBUG settings of the main packages at
+// pkgPaths, by package path. The go command derives them from the go version
+// and godebug directives of a package's module and its //go:debug directives.
+//
+// Packages without default settings are omitted. Only the go command of Go
+// 1.21 and later has default GODEBUG settings.
+func (c *Environ) DefaultGODEBUG(pkgPaths ...string) (map[string]string, error) {
+	if err := c.CompilerInit(); err != nil {
+		return nil, err
+	}
+	if c.Compiler.Type != CompilerGo {
+		return nil, nil
+	}
+	// Development versions are not valid semantic versions.
+	if v := "v" + strings.TrimPrefix(c.Compiler.VersionGo, "go"); semver.IsValid(v) && semver.Compare(v, "v1.21") < 0 {
+		return nil, nil
+	}
+
+	args := []string{"-f", "{{.ImportPath}}\t{{.DefaultGODEBUG}}"}
+	if len(c.Context.BuildTags) > 0 {
+		args = append(args, fmt.Sprintf("-tags=%s", strings.Join(c.Context.BuildTags, ",")))
+	}
+	if c.GO111MODULE != "off" && len(c.Mod) > 0 {
+		args = append(args, "-mod", string(c.Mod))
+	}
+	cmd := c.GoCmd("list", append(args, pkgPaths...)...)
+	var stderr bytes.Buffer
+	cmd.Stderr = &stderr
+	out, err := cmd.Output()
+	if err != nil {
+		return nil, fmt.Errorf("go list failed: %v: %s", err, stderr.String())
+	}
+
+	godebug := make(map[string]string)
+	for _, line := range strings.Split(strings.TrimSpace(string(out)), "\n") {
+		if pkgPath, settings, _ := strings.Cut(line, "\t"); settings != "" {
+			godebug[pkgPath] = settings
+		}
+	}
+	return godebug, nil
+}
+
 func (c Environ) envCommon() []string {
 	var env []string
 	if c.GOARCH != "" {
@@ -217,13 +286,37 @@ func (c Environ) envCommon() []string {
 	}
 	env = append(env, fmt.Sprintf("CGO_ENABLED=%d", cgo))
 	env = append(env, fmt.Sprintf("GO111MODULE=%s", c.GO111MODULE))
+	if c.GOWORK != "" {
+		env = append(env, fmt.Sprintf("GOWORK=%s", c.GOWORK))
+	}
 
 	if c.GOROOT != "" {
 		env = append(env, fmt.Sprintf("GOROOT=%s", c.GOROOT))
 	}
+	if c.NoModuleGOFLAGS {
+		if goflags, ok := withoutModuleFlags(os.Getenv("GOFLAGS")); ok {
+			env = append(env, fmt.Sprintf("GOFLAGS=%s", goflags))
+		}
+	}
 	return env
 }
 
+// withoutModuleFlags returns goflags without -mod and -modfile flags, and
+// whether there were any.
+func withoutModuleFlags(goflags string) (string, bool) {
+	var flags []string
+	var removed bool
+	for _, f := range strings.Fields(goflags) {
+		name, _, _ := strings.Cut(strings.TrimLeft(f, "-"), "=")
+		if name == "mod" || name == "modfile" {
+			removed = true
+			continue
+		}
+		flags = append(flags, f)
+	}
+	return strings.Join(flags, " "), removed
+}
+
 func (c Environ) EnvHuman() []string {
 	env := c.envCommon()
 	if c.GOROOT != "" {
@@ -269,6 +362,11 @@ type BuildOpts struct {
 	// reproducible.
 	NoTrimPath bool
 
+	// UseBuildCache does not force rebuilding all packages with -a, so
+	// that packages whose sources have not changed come from the Go build
+	// cache.
+	UseBuildCache bool
+
 	// ExtraArgs to `go build`.
 	ExtraArgs []string
 }
@@ -278,6 +376,7 @@ func (b *BuildOpts) RegisterFlags(f *flag.FlagSet) {
 	f.BoolVar(&b.NoStrip, "go-no-strip", false, "Do not strip symbols & Build ID from the binary (will not produce a reproducible binary)")
 	f.BoolVar(&b.EnableInlining, "go-enable-inlining", false, "Enable inlining (will likely produce a larger binary)")
 	f.BoolVar(&b.NoTrimPath, "go-no-trimpath", false, "Disable -trimpath (will not produce a reproducible binary)")
+	f.BoolVar(&b.UseBuildCache, "go-build-cache", false, "Do not force rebuilding all packages with -a, use the Go build cache")
 	f.Var((*uflag.Strings)(&b.ExtraArgs), "go-extra-args", "Extra args to 'go build'")
 }
 
@@ -0,0 +1,37 @@
+// Copyright 2024 the u-root Authors. All rights reserved
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package golang
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestWithoutModuleGOFLAGS(t *testing.T) {
+	for _, tt := range []struct {
+		goflags string
+		// want is the GOFLAGS set in the environment, if any.
+		want string
+	}{
+		{goflags: "", want: ""},
+		{goflags: "-trimpath", want: ""},
+		{goflags: "-modfile=/tmp/x.mod -mod=mod -trimpath", want: "GOFLAGS=-trimpath"},
+		{goflags: "--mod=vendor", want: "GOFLAGS="},
+		{goflags: "-modcacherw", want: ""},
+	} {
+		t.Run(tt.goflags, func(t *testing.T) {
+			t.Setenv("GOFLAGS", tt.goflags)
+			var got string
+			for _, kv := range Default(WithoutModuleGOFLAGS()).Env() {
+				if strings.HasPrefix(kv, "GOFLAGS=") {
+					got = kv
+				}
+			}
+			if got != tt.want {
+				t.Errorf("GOFLAGS in Env() = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
@@ -176,15 +176,38 @@ func (c *Environ) Version() (string, error) {
 	return c.Compiler.VersionGo, nil
 }
 
-func (c Environ) build(dirPath string, binaryPath string, pattern []string, opts *BuildOpts) error {
-	if err := c.CompilerInit(); err != nil {
-		return err
+// GoRoot returns the GOROOT of the go command in this environ, as `go env
+// GOROOT` reports it. Standard library packages are in its src directory.
+//
+// The go command, not the compiler, finds packages, so it is asked even if
+// the compiler is tinygo.
+func (c Environ) GoRoot() (string, error) {
+	goBin := "go"
+	if c.GOROOT != "" {
+		goBin = filepath.Join(c.GOROOT, "bin", "go")
+	}
+	cmd := exec.Command(goBin, "env", "GOROOT")
+	cmd.Dir = c.Dir
+	cmd.Env = append(os.Environ(), c.Env()...)
+	out, err := cmd.Output()
+	if err != nil {
+		return "", fmt.Errorf("go env GOROOT failed: %v", err)
+	}
+	goroot := strings.TrimSpace(string(out))
+	if goroot == "" {
+		return "", fmt.Errorf("go env GOROOT is empty")
 	}
+	return goroot, nil
+}
 
-	args := []string{
-		"-o", binaryPath,
+// BuildFlags returns the flags passed to the compiler's build command, other
+// than the output path, when building with opts.
+func (c Environ) BuildFlags(opts *BuildOpts) ([]string, error) {
+	if err := c.CompilerInit(); err != nil {
+		return nil, err
 	}
 
+	var args []string
 	if c.GO111MODULE != "off" && len(c.Mod) > 0 {
 		args = append(args, "-mod", string(c.Mod))
 	}
@@ -195,8 +218,10 @@ func (c Environ) build(dirPath string, binaryPath string, pattern []string, opts
 	switch c.Compiler.Type {
 	case CompilerGo:
 
-		// Force rebuilding of packages.
-		args = append(args, "-a")
+		if opts == nil || !opts.UseBuildCache {
+			// Force rebuilding of packages.
+			args = append(args, "-a")
+		}
 
 		if opts == nil || !opts.EnableInlining {
 			// Disable "function inlining" to get a (likely) smaller binary.
@@ -238,7 +263,15 @@ func (c Environ) build(dirPath string, binaryPath string, pattern []string, opts
 	if opts != nil {
 		args = append(args, opts.ExtraArgs...)
 	}
+	return args, nil
+}
 
+func (c Environ) build(dirPath string, binaryPath string, pattern []string, opts *BuildOpts) error {
+	flags, err := c.BuildFlags(opts)
+	if err != nil {
+		return err
+	}
+	args := append([]string{"-o", binaryPath}, flags...)
 	args = append(args, pattern...)
 
 	cmd := c.compilerCmd("build", args...)